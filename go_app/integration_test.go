@@ -0,0 +1,58 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// postgresImage the same Postgres version which is used by devcontainer
+const postgresImage = "postgres:13"
+
+// startPostgresContainer starts disposable Postgres in Docker and returns its connection string.
+// Container is removed when the test finishes.
+func startPostgresContainer(t *testing.T) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	container, err := postgres.Run(
+		ctx,
+		postgresImage,
+		postgres.WithDatabase("app"),
+		postgres.WithUsername("app"),
+		postgres.WithPassword("app"),
+		// Postgres restarts once after init scripts, so we wait for the second "ready" message
+		testcontainers.WithWaitStrategy(
+			wait.ForLog("database system is ready to accept connections").WithOccurrence(2).WithStartupTimeout(time.Minute),
+		),
+	)
+	if err != nil {
+		t.Fatalf("Failed to start Postgres container: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := container.Terminate(context.Background()); err != nil {
+			t.Errorf("Failed to terminate Postgres container: %v", err)
+		}
+	})
+	connString, err := container.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		t.Fatalf("Failed to get Postgres connection string: %v", err)
+	}
+	return connString
+}
+
+// The full handler test suite against Postgres started in Docker, so it doesn't need a database set up beforehand.
+// Run it with `go test -tags integration -run TestContainerAPISuiteRun .`
+func TestContainerAPISuiteRun(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Integration test is skipped in short mode")
+	}
+	t.Setenv("DATABASE_URL", startPostgresContainer(t))
+	suite.Run(t, &APITestSuite{driver: "postgres"})
+}
@@ -2,156 +2,5134 @@ package main
 
 // The same as python app we keep all code in one file for simplicity
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"database/sql"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/lmittmann/tint"
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/time/rate"
+	"io"
+	"io/fs"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
+
+	_ "modernc.org/sqlite" // registers "sqlite" database/sql driver
 )
 
 type Item struct {
-	ItemId string `json:"item_id"`
-	Value  string `json:"value"`
+	ItemId string `json:"item_id" xml:"item_id" binding:"required,itemid"`
+	// Value is a plain string, or raw JSON text when client sent any other JSON value, see ValueIsJSON
+	Value       string `json:"value" xml:"value" binding:"required,itemvalue"`
+	ValueIsJSON bool   `json:"-" xml:"value_is_json,omitempty"`
+	// TTLSeconds optional lifetime of a new item, item never expires when it's 0
+	TTLSeconds int `json:"ttl_seconds,omitempty" xml:"ttl_seconds,omitempty" binding:"omitempty,min=1" db:"-"`
+	// Attributes optional named JSON values kept together with Value, they aren't returned by list and search.
+	// XML doesn't support maps, so they are JSON only.
+	Attributes Attributes `json:"attributes,omitempty" xml:"-" db:"-"`
 }
 
-// HttpServerPort Port where we run HTTP server. For simplicity, we keep it static instead of ENV variable for example
-var HttpServerPort uint16 = 8000
+// Attributes named JSON values of item, they are kept in JSONB column in PostgreSQL and as JSON text in SQLite
+type Attributes map[string]json.RawMessage
 
-// OperationsTimeout - default timeout for all operations like DB connections
-var OperationsTimeout = 15 * time.Second
+// jsonText encodes attributes for DB, missing attributes are kept as empty object
+func (a Attributes) jsonText() string {
+	if len(a) == 0 {
+		return "{}"
+	}
+	encoded, _ := json.Marshal(a) // values are valid JSON, because they were decoded from JSON
+	return string(encoded)
+}
 
-// initDBStructure simple replacement for real-world DB migrations, it creates initial DB structure
-func initDBStructure(ctx context.Context, dbPool *pgxpool.Pool) error {
-	if _, err := dbPool.Exec(ctx, "CREATE TABLE IF NOT EXISTS data (id text PRIMARY KEY, value text);"); err != nil {
+// Scan decodes attributes read from DB
+func (a *Attributes) Scan(src any) error {
+	var data []byte
+	switch src := src.(type) {
+	case string:
+		data = []byte(src)
+	case []byte:
+		data = src
+	case nil:
+		*a = nil
+		return nil
+	default:
+		return fmt.Errorf("unexpected type %T of attributes", src)
+	}
+	return json.Unmarshal(data, a)
+}
+
+// nullableAttributes returns nil for attributes which aren't set, so they are passed to DB as NULL
+func nullableAttributes(attributes Attributes) any {
+	if attributes == nil {
+		return nil
+	}
+	return attributes.jsonText()
+}
+
+// itemJSON wire format of Item, value can be any JSON value
+type itemJSON struct {
+	ItemId     string          `json:"item_id"`
+	Value      json.RawMessage `json:"value"`
+	TTLSeconds int             `json:"ttl_seconds,omitempty"`
+	Attributes Attributes      `json:"attributes,omitempty"`
+}
+
+// parseValue converts JSON value from request to value kept by the store.
+// Strings are kept as is, all other JSON values are kept as compact JSON text, preserving keys order and numbers.
+// For missing or null value it returns empty string.
+func parseValue(raw json.RawMessage) (value string, isJSON bool, err error) {
+	raw = bytes.TrimSpace(raw)
+	switch {
+	case len(raw) == 0 || string(raw) == "null":
+		return "", false, nil
+	case raw[0] == '"':
+		err = json.Unmarshal(raw, &value)
+		return value, false, err
+	default:
+		var compacted bytes.Buffer
+		if err = json.Compact(&compacted, raw); err != nil {
+			return "", false, err
+		}
+		return compacted.String(), true, nil
+	}
+}
+
+// valueJSON converts value kept by the store back to JSON value for response
+func valueJSON(value string, isJSON bool) json.RawMessage {
+	if isJSON {
+		return json.RawMessage(value)
+	}
+	encoded, _ := json.Marshal(value) // encoding of a string can't fail
+	return encoded
+}
+
+func (i Item) MarshalJSON() ([]byte, error) {
+	return json.Marshal(itemJSON{
+		ItemId:     i.ItemId,
+		Value:      valueJSON(i.Value, i.ValueIsJSON),
+		TTLSeconds: i.TTLSeconds,
+		Attributes: i.Attributes,
+	})
+}
+
+func (i *Item) UnmarshalJSON(data []byte) error {
+	var decoded itemJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
 		return err
 	}
-	slog.Info("Database structure initialized")
+	item, err := decoded.item()
+	*i = item
+	return err
+}
+
+// item converts wire format to Item
+func (d itemJSON) item() (Item, error) {
+	value, isJSON, err := parseValue(d.Value)
+	return Item{ItemId: d.ItemId, Value: value, ValueIsJSON: isJSON, TTLSeconds: d.TTLSeconds, Attributes: d.Attributes}, err
+}
+
+// NewItem body of create request, item_id is optional there. When it's missing or null, a random UUID
+// is generated while decoding, so item is valid for binding and clients which don't care about IDs get one.
+type NewItem struct {
+	Item
+}
+
+func (n *NewItem) UnmarshalJSON(data []byte) error {
+	var fields struct {
+		ItemId *string `json:"item_id"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if err := n.Item.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	if fields.ItemId == nil {
+		n.ItemId = uuid.NewString()
+	}
+	return nil
+}
+
+// expiresAt returns expiration time of a new item created at now, or nil if item never expires
+func (i Item) expiresAt(now time.Time) *time.Time {
+	if i.TTLSeconds == 0 {
+		return nil
+	}
+	expiresAt := now.Add(time.Duration(i.TTLSeconds) * time.Second)
+	return &expiresAt
+}
+
+// StoredItem item with metadata kept by the store
+type StoredItem struct {
+	Item
+	CreatedAt time.Time  `json:"created_at" xml:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" xml:"updated_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" xml:"expires_at,omitempty"`
+}
+
+// storedItemXML XML representation of StoredItem, JSON values are kept as JSON text with value_is_json flag
+type storedItemXML struct {
+	XMLName xml.Name `xml:"item"`
+	StoredItem
+}
+
+// expired checks if item with TTL expired at the moment now
+func (i StoredItem) expired(now time.Time) bool {
+	return i.ExpiresAt != nil && !i.ExpiresAt.After(now)
+}
+
+// storedItemJSON wire format of StoredItem
+type storedItemJSON struct {
+	itemJSON
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// MarshalJSON is required, because otherwise StoredItem gets MarshalJSON of the embedded Item,
+// which drops timestamps. The same is true for UnmarshalJSON.
+func (i StoredItem) MarshalJSON() ([]byte, error) {
+	return json.Marshal(i.wireFormat())
+}
+
+// wireFormat converts item to its wire format
+func (i StoredItem) wireFormat() storedItemJSON {
+	return storedItemJSON{
+		itemJSON: itemJSON{
+			ItemId:     i.ItemId,
+			Value:      valueJSON(i.Value, i.ValueIsJSON),
+			TTLSeconds: i.TTLSeconds,
+			Attributes: i.Attributes,
+		},
+		CreatedAt: i.CreatedAt,
+		UpdatedAt: i.UpdatedAt,
+		ExpiresAt: i.ExpiresAt,
+	}
+}
+
+// WrittenItem response of POST endpoints, it tells client whether item was created or existing item was updated,
+// so client doesn't need to check it with another request
+type WrittenItem struct {
+	StoredItem
+	Created bool
+}
+
+func (i WrittenItem) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		storedItemJSON
+		Created bool `json:"created"`
+	}{storedItemJSON: i.wireFormat(), Created: i.Created})
+}
+
+func (i *StoredItem) UnmarshalJSON(data []byte) error {
+	var decoded storedItemJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	item, err := decoded.item()
+	*i = StoredItem{Item: item, CreatedAt: decoded.CreatedAt, UpdatedAt: decoded.UpdatedAt, ExpiresAt: decoded.ExpiresAt}
+	return err
+}
+
+// ItemUpdate request body for PUT endpoint, item ID is taken from the path
+type ItemUpdate struct {
+	// Value the same as Item.Value
+	Value       string `json:"value" binding:"required,itemvalue"`
+	ValueIsJSON bool   `json:"-"`
+	// Attributes replace attributes of the item, when they are nil, attributes are kept as is
+	Attributes Attributes `json:"attributes"`
+}
+
+func (u *ItemUpdate) UnmarshalJSON(data []byte) error {
+	var decoded struct {
+		Value      json.RawMessage `json:"value"`
+		Attributes Attributes      `json:"attributes"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	value, isJSON, err := parseValue(decoded.Value)
+	if err != nil {
+		return err
+	}
+	*u = ItemUpdate{Value: value, ValueIsJSON: isJSON, Attributes: decoded.Attributes}
+	return nil
+}
+
+// BatchGetRequest request body for batch GET endpoint
+type BatchGetRequest struct {
+	IDs []string `json:"ids" binding:"required"`
+}
+
+// BulkDeleteRequest request body for bulk delete endpoint
+type BulkDeleteRequest struct {
+	IDs []string `json:"ids" binding:"required"`
+}
+
+// MaxItemIDLength max number of characters in item ID
+const MaxItemIDLength = 256
+
+// MaxValueLength max number of characters in item value
+const MaxValueLength = 4096
+
+// FieldError validation error of a single request field, responses with 400 code list them in error details
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (e FieldError) Error() string {
+	return e.Field + " " + e.Reason
+}
+
+// validateText checks that field value is valid UTF-8 without NUL characters, PostgreSQL can't keep them in text.
+// JSON decoder replaces invalid UTF-8 in strings, but it can still come in JSON values or path parameters.
+func validateText(field string, value string) error {
+	if !utf8.ValidString(value) {
+		return FieldError{Field: field, Reason: "must be valid UTF-8"}
+	}
+	if strings.ContainsRune(value, 0) {
+		return FieldError{Field: field, Reason: "must not contain NUL characters"}
+	}
+	return nil
+}
+
+// validateItemID checks that item ID isn't empty or whitespace-only, is valid text and isn't longer
+// than MaxItemIDLength. Whitespace-only IDs come from paths like "/%20", they can't be told apart in URLs and logs.
+func validateItemID(itemID string) error {
+	if itemID == "" {
+		return FieldError{Field: "item_id", Reason: "must not be empty"}
+	}
+	if strings.TrimSpace(itemID) == "" {
+		return FieldError{Field: "item_id", Reason: "must not be blank"}
+	}
+	if err := validateText("item_id", itemID); err != nil {
+		return err
+	}
+	if utf8.RuneCountInString(itemID) > MaxItemIDLength {
+		return FieldError{Field: "item_id", Reason: fmt.Sprintf("must not be longer than %d characters", MaxItemIDLength)}
+	}
+	return nil
+}
+
+// validateValue checks that item value isn't empty, is valid text and isn't longer than MaxValueLength
+func validateValue(value string) error {
+	if value == "" {
+		return FieldError{Field: "value", Reason: "must not be empty"}
+	}
+	if err := validateText("value", value); err != nil {
+		return err
+	}
+	if utf8.RuneCountInString(value) > MaxValueLength {
+		return FieldError{Field: "value", Reason: fmt.Sprintf("must not be longer than %d characters", MaxValueLength)}
+	}
+	return nil
+}
+
+// fieldValidators custom binding tags, they reuse validate functions, so binding and handlers check fields
+// the same way and apply the same limits like MaxItemIDLength
+var fieldValidators = map[string]func(string) error{
+	"itemid":    validateItemID,
+	"itemvalue": validateValue,
+}
+
+// registerValidators registers fieldValidators in Gin validator, and makes it name fields by their JSON names
+var registerValidators = sync.OnceValue(func() error {
+	validate, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return errors.New("unexpected validator engine")
+	}
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	for tag, validateField := range fieldValidators {
+		err := validate.RegisterValidation(tag, func(field validator.FieldLevel) bool {
+			return validateField(field.Field().String()) == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+})
+
+// bindingErrors validates obj with binding tags and converts failures to FieldError values joined together.
+// Elements of slices are validated one by one, so their fields are prefixed with index, e.g. [2].item_id.
+func bindingErrors(obj any) error {
+	value := reflect.Indirect(reflect.ValueOf(obj))
+	if value.Kind() == reflect.Slice {
+		var fields []error
+		for i := 0; i < value.Len(); i++ {
+			for _, field := range joinedFieldErrors(bindingErrors(value.Index(i).Interface())) {
+				fields = append(fields, FieldError{Field: fmt.Sprintf("[%d].%s", i, field.Field), Reason: field.Reason})
+			}
+		}
+		return errors.Join(fields...)
+	}
+	var validationErrors validator.ValidationErrors
+	if !errors.As(binding.Validator.ValidateStruct(obj), &validationErrors) {
+		return nil
+	}
+	fields := make([]error, 0, len(validationErrors))
+	for _, failure := range validationErrors {
+		field := FieldError{Field: failure.Field(), Reason: "is invalid"}
+		switch failure.Tag() {
+		case "required":
+			field.Reason = "is required"
+		case "min":
+			field.Reason = "must be at least " + failure.Param()
+		default:
+			var fieldErr FieldError
+			if validateField, ok := fieldValidators[failure.Tag()]; ok &&
+				errors.As(validateField(fmt.Sprint(failure.Value())), &fieldErr) {
+				field.Reason = fieldErr.Reason
+			}
+		}
+		fields = append(fields, field)
+	}
+	return errors.Join(fields...)
+}
+
+// respondValidationError responds with 400 code and lists invalid fields, err is FieldError
+// returned by validate functions, or several of them joined with errors.Join
+func respondValidationError(c *gin.Context, err error) {
+	respondJSON(c, http.StatusBadRequest, gin.H{"error": gin.H{
+		"code":    ErrorCodeInvalidRequest,
+		"message": err.Error(),
+		"fields":  joinedFieldErrors(err),
+	}})
+}
+
+// joinedFieldErrors collects FieldError values from err and errors joined in it
+func joinedFieldErrors(err error) []FieldError {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		fields := []FieldError{}
+		for _, err := range joined.Unwrap() {
+			fields = append(fields, joinedFieldErrors(err)...)
+		}
+		return fields
+	}
+	var fieldErr FieldError
+	if errors.As(err, &fieldErr) {
+		return []FieldError{fieldErr}
+	}
+	return []FieldError{}
+}
+
+// Config settings of the app, LoadConfig reads them from env variables once on start,
+// and they are passed to the parts of the app which use them
+type Config struct {
+	// Port where we run HTTP server. Can be set with PORT env variable.
+	Port uint16
+	// BindAddress host or IP of the interface where HTTP server listens, empty value means all interfaces.
+	// Can be set with BIND_ADDRESS env variable.
+	BindAddress string
+	// TLSCertFile and TLSKeyFile paths to PEM encoded certificate and private key. When both are set, server serves
+	// HTTPS instead of plain HTTP. Can be set with TLS_CERT_FILE and TLS_KEY_FILE env variables.
+	TLSCertFile string
+	TLSKeyFile  string
+	// EnableH2C enables HTTP/2 over plain TCP (h2c) for clients which use it with prior knowledge, HTTP/1.1 still
+	// works. Can be set with ENABLE_H2C env variable.
+	EnableH2C bool
+	// MaxHeaderBytes max size of request line and headers, server responds 431 to requests with bigger headers.
+	// Can be set with MAX_HEADER_BYTES env variable.
+	MaxHeaderBytes int
+	// ServerReadTimeout max duration of reading request headers and body, it protects from clients which send data
+	// too slowly. It doesn't limit /import, which lifts it, because its body isn't limited by MaxBodyBytes.
+	// Can be set with SERVER_READ_TIMEOUT env variable, 0 disables it.
+	ServerReadTimeout time.Duration
+	// ServerWriteTimeout max duration from the end of reading request headers to the end of writing response.
+	// It must be longer than RequestTimeout, otherwise connection is closed before client gets 504 code from
+	// requestTimeoutMiddleware. It also limits duration of pprof profiling, but not of /import and /export,
+	// which lift it, because they stream any number of items.
+	// Can be set with SERVER_WRITE_TIMEOUT env variable, 0 disables it.
+	ServerWriteTimeout time.Duration
+	// ServerIdleTimeout how long keep-alive connection waits for the next request.
+	// Can be set with SERVER_IDLE_TIMEOUT env variable, 0 disables it.
+	ServerIdleTimeout time.Duration
+	// RequestTimeout max duration of a request, after it request context is canceled and client gets 504 code.
+	// 0 disables the timeout. Can be set with REQUEST_TIMEOUT env variable.
+	RequestTimeout time.Duration
+	// ShutdownTimeout how long we wait for in-flight requests to finish during graceful shutdown,
+	// can be changed with SHUTDOWN_TIMEOUT env variable
+	ShutdownTimeout time.Duration
+	// OperationsTimeout default timeout for all operations like DB connections
+	OperationsTimeout time.Duration
+	// GinMode mode of Gin: debug, release or test. Can be set with GIN_MODE env variable,
+	// by default it's debug for "development" APP_ENV and release otherwise.
+	GinMode string
+	// LogLevel and LogFormat of messages we log, can be set with LOG_LEVEL and LOG_FORMAT env variables
+	LogLevel  slog.Level
+	LogFormat string
+
+	// PrettyJSON indents JSON responses, it's handy for debugging, but compact responses are smaller.
+	// Can be set with PRETTY_JSON env variable.
+	PrettyJSON bool
+	// MaxBodyBytes max size of request body we accept, can be changed with MAX_BODY_BYTES env variable
+	MaxBodyBytes int64
+	// APIPrefix path prefix of API routes, e.g. /api/v1 when app runs behind path-based reverse proxy.
+	// Probes, /version and pprof handlers aren't prefixed. Can be set with API_PREFIX env variable.
+	APIPrefix string
+	// GzipMinSize responses not smaller than this number of bytes are compressed with gzip, if client accepts it.
+	// Can be set with GZIP_MIN_SIZE env variable.
+	GzipMinSize int
+	// CORSAllowedOrigins origins allowed to call API from browsers, "*" allows any origin.
+	// Empty list disables CORS headers. Can be set with comma-separated CORS_ALLOWED_ORIGINS env variable.
+	CORSAllowedOrigins []string
+	// TrustedProxies CIDRs of proxies, which X-Forwarded-For header is trusted from to detect client IP.
+	// Empty list disables proxy headers parsing. Can be set with comma-separated TRUSTED_PROXIES env variable.
+	TrustedProxies []string
+	// EnablePprof registers net/http/pprof handlers under /debug/pprof/ when true, they require API key if it's set.
+	// It's disabled by default, because profiles expose internals of the app. Can be set with ENABLE_PPROF
+	// env variable.
+	EnablePprof bool
+	// EnableDebugConfig registers GET /debug/config endpoint returning effective configuration with secrets
+	// redacted, it requires API key if it's set. It's disabled by default. Can be set with ENABLE_DEBUG_CONFIG
+	// env variable.
+	EnableDebugConfig bool
+	// AllowedContentTypes content types accepted for request bodies, parameters like charset are ignored.
+	// Can be set as comma-separated list with ALLOWED_CONTENT_TYPES env variable.
+	AllowedContentTypes []string
+	// AllowTruncate enables DELETE / endpoint which removes all items, it's handy for tests and demos,
+	// but it's disabled by default to prevent accidental data loss. Can be set with ALLOW_TRUNCATE env variable.
+	AllowTruncate bool
+	// APIKey shared secret which clients must send in X-API-Key header to modify data.
+	// Empty value disables authentication. Can be set with API_KEY env variable.
+	APIKey string
+	// CacheSize max number of items kept in memory to serve GET requests without DB, 0 disables the cache.
+	// Can be set with CACHE_SIZE env variable.
+	CacheSize int
+	// CacheControlMaxAge number of seconds CDNs and browsers may cache successful GET responses of the API,
+	// 0 disables caching headers. Can be set with CACHE_CONTROL_MAX_AGE env variable.
+	CacheControlMaxAge int
+	// ConflictStatus status code returned by POST for item which already exists: 200(default) without body,
+	// or 409 with error in the body. Can be set with CONFLICT_STATUS env variable
+	ConflictStatus int
+	// RateLimitRPS number of requests per second allowed for every client IP, 0 disables rate limiting.
+	// Can be set with RATE_LIMIT_RPS env variable.
+	RateLimitRPS float64
+	// RateLimitBurst max number of requests client can send at once above RateLimitRPS.
+	// Can be set with RATE_LIMIT_BURST env variable, by default it's RateLimitRPS rounded up.
+	RateLimitBurst int
+	// MaxConcurrentPerIP max number of requests of a single client IP served at the same time, other requests get
+	// 429 code. It keeps one client from taking all DB connections. 0 disables the limit.
+	// Can be set with MAX_CONCURRENT_PER_IP env variable.
+	MaxConcurrentPerIP int
+	// IdempotencyWindow how long responses of POST requests with Idempotency-Key header are kept to be replayed
+	// for retried requests, can be set with IDEMPOTENCY_WINDOW env variable
+	IdempotencyWindow time.Duration
+	// MaxBatchGetIDs max number of IDs accepted by batch GET endpoint, can be set with MAX_BATCH_GET_IDS env variable
+	MaxBatchGetIDs int
+	// MaxBulkItems max number of items accepted by bulk insert endpoint, can be set with MAX_BULK_ITEMS env variable
+	MaxBulkItems int
+	// MaxBulkDeleteIDs max number of IDs accepted by bulk delete endpoint,
+	// can be set with MAX_BULK_DELETE_IDS env variable
+	MaxBulkDeleteIDs int
+	// DefaultListLimit number of items returned by list endpoint when limit isn't specified
+	DefaultListLimit int
+	// MaxListLimit upper bound for the limit of list and search endpoints, bigger values are clamped to it.
+	// It balances number of requests clients make and load of a single query on DB.
+	// Can be set with MAX_LIST_LIMIT env variable.
+	MaxListLimit int
+	// MaxListOffset upper bound for the offset of list endpoint, bigger values are clamped to it,
+	// so a single request can't make DB scan and skip millions of rows. Can be set with MAX_LIST_OFFSET env variable.
+	MaxListOffset int
+	// MaxSearchQueryLength max number of characters in search query, longer queries get 400 code.
+	// Can be set with MAX_SEARCH_QUERY_LENGTH env variable.
+	MaxSearchQueryLength int
+
+	// OTLPEndpoint URL of OpenTelemetry collector where we export traces, empty value disables tracing.
+	// Can be set with OTEL_EXPORTER_OTLP_ENDPOINT env variable.
+	OTLPEndpoint string
+	// WebhookURL URL which gets POST request with every created item, empty value disables notifications.
+	// Can be set with WEBHOOK_URL env variable.
+	WebhookURL string
+	// WebhookWorkers max number of webhook requests sent concurrently, can be set with WEBHOOK_WORKERS env variable
+	WebhookWorkers int
+	// WebhookAttempts max number of attempts to deliver a notification, can be set with WEBHOOK_ATTEMPTS env variable
+	WebhookAttempts int
+	// KafkaBrokers addresses of Kafka brokers, where events about changed items are published to KafkaTopic.
+	// Empty list disables publishing. Can be set with comma-separated KAFKA_BROKERS env variable.
+	KafkaBrokers []string
+	// KafkaTopic Kafka topic for events about changed items, can be set with KAFKA_TOPIC env variable
+	KafkaTopic string
+	// ExpirySweepInterval how often expired items are removed from DB,
+	// can be set with EXPIRY_SWEEP_INTERVAL env variable
+	ExpirySweepInterval time.Duration
+	// HealthCheckInterval how often DB is pinged in background to update readiness,
+	// can be set with HEALTH_CHECK_INTERVAL env variable
+	HealthCheckInterval time.Duration
+
+	// DBDriver database backend: "postgres"(default) or "sqlite", can be set with DB_DRIVER env variable
+	DBDriver string
+	// SQLitePath path to SQLite database file used by "sqlite" driver, can be set with SQLITE_PATH env variable
+	SQLitePath string
+	// DatabaseURL connection string of PostgreSQL, when it's empty, pgx reads connection parameters from
+	// PG* env variables. Can be set with DATABASE_URL env variable.
+	DatabaseURL string
+	// DatabaseReplicaURL connection string of PostgreSQL read replica, reads are sent to it when it's set.
+	// Can be set with DATABASE_REPLICA_URL env variable.
+	DatabaseReplicaURL string
+	// PoolMaxConns, PoolMinConns, PoolMaxConnLifetime and PoolMaxConnIdleTime settings of DB connection pool,
+	// 0 keeps pgx default. Can be set with POOL_MAX_CONNS, POOL_MIN_CONNS, POOL_MAX_CONN_LIFETIME
+	// and POOL_MAX_CONN_IDLE_TIME env variables.
+	PoolMaxConns        int
+	PoolMinConns        int
+	PoolMaxConnLifetime time.Duration
+	PoolMaxConnIdleTime time.Duration
+	// DBStatementTimeout Postgres statement_timeout, it aborts runaway queries in DB itself, so they don't pin
+	// connections when context deadline is generous. 0 keeps timeout of the connection string or DB server.
+	// Can be set with DB_STATEMENT_TIMEOUT env variable, by default it's a minute, unless connection string
+	// sets it. It's generous, so exports and migrations fit into it.
+	DBStatementTimeout time.Duration
+	// DBStatementTimeoutExplicit DBStatementTimeout is set with DB_STATEMENT_TIMEOUT env variable, so it overrides
+	// statement_timeout of the connection string instead of giving way to it like the default one does
+	DBStatementTimeoutExplicit bool
+	// PgBouncerMode makes pool work behind PgBouncer in transaction pooling mode, where consecutive queries may go
+	// to different server connections, so prepared statements cached on one of them aren't found. Queries are sent
+	// with simple protocol and statement caches are disabled. It's disabled by default, because prepared statements
+	// are faster. DB_STATEMENT_TIMEOUT isn't sent in this mode, because PgBouncer rejects it as startup parameter.
+	// Can be set with PGBOUNCER_MODE env variable.
+	PgBouncerMode bool
+	// DBAcquireTimeout how long a store call waits for a free connection from the pool, when all connections are
+	// busy. Requests which don't get a connection in time get 503. Can be set with DB_ACQUIRE_TIMEOUT env variable.
+	DBAcquireTimeout time.Duration
+	// DBConnectAttempts max number of attempts to connect to the database on start,
+	// can be set with DB_CONNECT_ATTEMPTS env variable
+	DBConnectAttempts int
+	// DBConnectRetryDelay delay before the first retry of DB connection, it doubles with every next retry.
+	// Can be set with DB_CONNECT_RETRY_DELAY env variable
+	DBConnectRetryDelay time.Duration
+	// DBPoolRestartFailures number of consecutive failed health checks after which DB connection pool is recreated,
+	// it helps to recover from broken connections after DB failover faster than restarting the app. 0 disables it.
+	// Can be set with DB_POOL_RESTART_FAILURES env variable.
+	DBPoolRestartFailures int
+	// DBQueryAttempts max number of attempts of reads and idempotent writes, which fail with transient DB errors
+	// like serialization failures or lost connections. 1 disables retries. Can be set with DB_QUERY_ATTEMPTS
+	// env variable.
+	DBQueryAttempts int
+	// SlowQueryThreshold store calls taking longer than this are logged with a warning, 0 disables the log.
+	// Can be set with SLOW_QUERY_THRESHOLD env variable.
+	SlowQueryThreshold time.Duration
+}
+
+// DefaultConfig returns settings the app runs with when no env variables are set
+func DefaultConfig() Config {
+	return Config{
+		Port:                  8000,
+		MaxHeaderBytes:        64 << 10,
+		ServerReadTimeout:     15 * time.Second,
+		ServerWriteTimeout:    60 * time.Second,
+		ServerIdleTimeout:     120 * time.Second,
+		ShutdownTimeout:       15 * time.Second,
+		OperationsTimeout:     15 * time.Second,
+		GinMode:               gin.ReleaseMode,
+		LogLevel:              slog.LevelInfo,
+		LogFormat:             "text",
+		MaxBodyBytes:          1 << 20,
+		GzipMinSize:           1024,
+		AllowedContentTypes:   []string{"application/json"},
+		ConflictStatus:        http.StatusOK,
+		IdempotencyWindow:     24 * time.Hour,
+		MaxBatchGetIDs:        1000,
+		MaxBulkItems:          1000,
+		MaxBulkDeleteIDs:      1000,
+		DefaultListLimit:      50,
+		MaxListLimit:          500,
+		MaxListOffset:         100000,
+		MaxSearchQueryLength:  256,
+		WebhookWorkers:        4,
+		WebhookAttempts:       3,
+		ExpirySweepInterval:   time.Minute,
+		HealthCheckInterval:   10 * time.Second,
+		DBDriver:              "postgres",
+		SQLitePath:            "app.db",
+		DBStatementTimeout:    time.Minute,
+		DBAcquireTimeout:      2 * time.Second,
+		DBConnectAttempts:     5,
+		DBConnectRetryDelay:   500 * time.Millisecond,
+		DBPoolRestartFailures: 3,
+		DBQueryAttempts:       3,
+		SlowQueryThreshold:    200 * time.Millisecond,
+	}
+}
+
+// LogLevel minimal level of messages we log, it's a variable so it can be changed at runtime on config reload
+var LogLevel = new(slog.LevelVar)
+
+// tracerName name of the tracer and the service in exported traces
+const tracerName = "go_app"
+
+// Build metadata returned by /version endpoint, it's injected at build time with
+// -ldflags "-X main.Version=... -X main.Commit=... -X main.BuildTime=..."
+var (
+	Version   = "dev"
+	Commit    = "dev"
+	BuildTime = "dev"
+)
+
+// parseLogLevel converts LOG_LEVEL env variable value(debug, info, warn, error) to slog level, case-insensitive.
+// Empty value means INFO level. For unknown values it returns INFO level and an error.
+func parseLogLevel(value string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q, expected one of debug, info, warn, error", value)
+	}
+}
+
+// parseGinMode returns Gin mode for GIN_MODE and APP_ENV env variables values. GIN_MODE(debug, release, test)
+// takes precedence, otherwise it's debug mode for "development" APP_ENV, and release mode for anything else,
+// so production doesn't get verbose debug logs by accident.
+func parseGinMode(ginMode string, appEnv string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(ginMode)) {
+	case "":
+		if strings.EqualFold(strings.TrimSpace(appEnv), "development") {
+			return gin.DebugMode, nil
+		}
+		return gin.ReleaseMode, nil
+	case gin.DebugMode:
+		return gin.DebugMode, nil
+	case gin.ReleaseMode:
+		return gin.ReleaseMode, nil
+	case gin.TestMode:
+		return gin.TestMode, nil
+	default:
+		return gin.ReleaseMode, fmt.Errorf("unknown gin mode %q, expected one of debug, release, test", ginMode)
+	}
+}
+
+// newLogHandler creates slog handler for LOG_FORMAT env variable value: colorized human-readable "text"
+// (default, good for development) or "json" (easy to parse by log aggregators).
+// For unknown format it returns text handler and an error.
+func newLogHandler(w io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", "text":
+		return requestIDLogHandler{tint.NewHandler(w, &tint.Options{Level: level})}, nil
+	case "json":
+		return requestIDLogHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})}, nil
+	default:
+		return requestIDLogHandler{tint.NewHandler(w, &tint.Options{Level: level})},
+			fmt.Errorf("unknown log format %q, expected one of text, json", format)
+	}
+}
+
+// requestIDLogHandler adds request_id attribute to records logged with context of a request
+type requestIDLogHandler struct {
+	slog.Handler
+}
+
+func (h requestIDLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		record.AddAttrs(slog.String("request_id", requestID))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDLogHandler) WithGroup(name string) slog.Handler {
+	return requestIDLogHandler{h.Handler.WithGroup(name)}
+}
+
+// durationFromEnv reads positive duration in Go format(e.g. 30s) from env variable.
+// It returns defaultValue when the variable isn't set.
+func durationFromEnv(name string, defaultValue time.Duration) (time.Duration, error) {
+	raw, ok := os.LookupEnv(name)
+	if !ok || raw == "" {
+		return defaultValue, nil
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a duration like 30s: %w", name, err)
+	}
+	if value <= 0 {
+		return 0, fmt.Errorf("%s must be positive, got %s", name, raw)
+	}
+	return value, nil
+}
+
+// durationOrZeroFromEnv the same as durationFromEnv, but it also accepts 0, which disables a feature
+func durationOrZeroFromEnv(name string, defaultValue time.Duration) (time.Duration, error) {
+	raw, ok := os.LookupEnv(name)
+	if !ok || raw == "" {
+		return defaultValue, nil
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a duration like 30s: %w", name, err)
+	}
+	if value < 0 {
+		return 0, fmt.Errorf("%s must not be negative, got %s", name, raw)
+	}
+	return value, nil
+}
+
+// parseAPIPrefix validates prefix of API routes and removes trailing slash from it, empty prefix means root
+func parseAPIPrefix(raw string) (string, error) {
+	prefix := strings.TrimRight(raw, "/")
+	if prefix == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return "", fmt.Errorf("prefix must start with /, got %q", raw)
+	}
+	if strings.ContainsAny(prefix, ":*") {
+		return "", fmt.Errorf("prefix must not contain route parameters, got %q", raw)
+	}
+	return prefix, nil
+}
+
+// listenAddress builds address for HTTP server from bind host and port. Host can be an IP, optionally in brackets
+// for IPv6, or a host name. Empty host means all interfaces.
+func listenAddress(host string, port uint16) (string, error) {
+	if host == "" {
+		return fmt.Sprintf(":%d", port), nil
+	}
+	// JoinHostPort adds brackets to IPv6 itself
+	if ip := strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"); net.ParseIP(ip) != nil {
+		host = ip
+	} else if !validHostName(host) {
+		return "", fmt.Errorf("expected IP or host name without port, got %q", host)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// checkTLSFiles checks that TLS certificate and key are either both set or both empty, and that they can be loaded
+func checkTLSFiles(certFile string, keyFile string) error {
+	if certFile == "" && keyFile == "" {
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		return errors.New("certificate and key files must be set together")
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return fmt.Errorf("failed to load certificate and key: %w", err)
+	}
 	return nil
 }
 
-// connectToDB creates a new database connection pool and cleans up the pool when done.
-// It expects a context and WaitGroup for pool cleanup goroutine
-// It returns a channel where bool must be written to clean up the pool.
-func connectToDB(ctx context.Context, wg *sync.WaitGroup) (*pgxpool.Pool, chan bool, error) {
-	cleanDBPoolChannel := make(chan bool, 1)
-	dbPool, err := pgxpool.New(ctx, "") // for simplicity, we use env variable to define connection parameters
-	if err != nil {
-		return nil, cleanDBPoolChannel, err
-	}
-	err = dbPool.Ping(ctx)
-	if err != nil {
-		dbPool.Close()
-		return nil, cleanDBPoolChannel, err
-	}
-	slog.Info("Connected to the database",
-		slog.String("host", dbPool.Config().ConnConfig.Host),
-		slog.Uint64("port", uint64(dbPool.Config().ConnConfig.Port)),
-		slog.String("database", dbPool.Config().ConnConfig.Database),
-		slog.String("user", dbPool.Config().ConnConfig.User),
-	)
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for {
-			select {
-			case <-cleanDBPoolChannel:
-				if dbPool != nil {
-					slog.Info("Closing db-pool...")
-					dbPool.Close()
+// validHostName checks that name consists of dot-separated labels of letters, digits and hyphens
+func validHostName(name string) bool {
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// intFromEnv reads integer not less than minValue from env variable.
+// It returns defaultValue when the variable isn't set.
+func intFromEnv(name string, defaultValue int, minValue int) (int, error) {
+	raw, ok := os.LookupEnv(name)
+	if !ok || raw == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer: %w", name, err)
+	}
+	if value < minValue {
+		return 0, fmt.Errorf("%s must be at least %d, got %d", name, minValue, value)
+	}
+	return value, nil
+}
+
+// floatFromEnv reads non-negative float number from env variable.
+// It returns defaultValue when the variable isn't set.
+func floatFromEnv(name string, defaultValue float64) (float64, error) {
+	raw, ok := os.LookupEnv(name)
+	if !ok || raw == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number: %w", name, err)
+	}
+	if value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("%s must be a non-negative number, got %s", name, raw)
+	}
+	return value, nil
+}
+
+// listFromEnv reads comma-separated list from env variable, skipping empty elements
+func listFromEnv(name string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// parseTrustedProxies validates list of CIDRs, single IP addresses are accepted as well
+func parseTrustedProxies(values []string) ([]string, error) {
+	for _, value := range values {
+		if _, _, err := net.ParseCIDR(value); err != nil && net.ParseIP(value) == nil {
+			return nil, fmt.Errorf("invalid CIDR %q", value)
+		}
+	}
+	return values, nil
+}
+
+// boolFromEnv reads boolean env variable, e.g. true, false, 1 or 0. It returns defaultValue when the variable
+// isn't set.
+func boolFromEnv(name string, defaultValue bool) (bool, error) {
+	raw, ok := os.LookupEnv(name)
+	if !ok || raw == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("%s must be a boolean: %w", name, err)
+	}
+	return value, nil
+}
+
+// LoadConfig reads settings from env variables on top of DefaultConfig, and validates them.
+// It returns an error pointing to the first invalid env variable.
+func LoadConfig() (Config, error) {
+	cfg := DefaultConfig()
+	var err error
+	if cfg.LogLevel, err = parseLogLevel(os.Getenv("LOG_LEVEL")); err != nil {
+		return Config{}, fmt.Errorf("invalid LOG_LEVEL env variable: %w", err)
+	}
+	if format := strings.ToLower(strings.TrimSpace(os.Getenv("LOG_FORMAT"))); format != "" {
+		if _, err = newLogHandler(io.Discard, format, cfg.LogLevel); err != nil {
+			return Config{}, fmt.Errorf("invalid LOG_FORMAT env variable: %w", err)
+		}
+		cfg.LogFormat = format
+	}
+	if cfg.GinMode, err = parseGinMode(os.Getenv("GIN_MODE"), os.Getenv("APP_ENV")); err != nil {
+		return Config{}, fmt.Errorf("invalid GIN_MODE env variable: %w", err)
+	}
+
+	for _, setting := range []struct {
+		name     string
+		value    *int
+		minValue int
+	}{
+		{"MAX_HEADER_BYTES", &cfg.MaxHeaderBytes, 1},
+		{"GZIP_MIN_SIZE", &cfg.GzipMinSize, 0},
+		{"CACHE_SIZE", &cfg.CacheSize, 0},
+		{"CACHE_CONTROL_MAX_AGE", &cfg.CacheControlMaxAge, 0},
+		{"MAX_CONCURRENT_PER_IP", &cfg.MaxConcurrentPerIP, 0},
+		{"MAX_BATCH_GET_IDS", &cfg.MaxBatchGetIDs, 1},
+		{"MAX_BULK_ITEMS", &cfg.MaxBulkItems, 1},
+		{"MAX_BULK_DELETE_IDS", &cfg.MaxBulkDeleteIDs, 1},
+		{"MAX_LIST_LIMIT", &cfg.MaxListLimit, 1},
+		{"MAX_LIST_OFFSET", &cfg.MaxListOffset, 0},
+		{"MAX_SEARCH_QUERY_LENGTH", &cfg.MaxSearchQueryLength, 1},
+		{"WEBHOOK_WORKERS", &cfg.WebhookWorkers, 1},
+		{"WEBHOOK_ATTEMPTS", &cfg.WebhookAttempts, 1},
+		{"POOL_MAX_CONNS", &cfg.PoolMaxConns, 1},
+		{"POOL_MIN_CONNS", &cfg.PoolMinConns, 0},
+		{"DB_CONNECT_ATTEMPTS", &cfg.DBConnectAttempts, 1},
+		{"DB_POOL_RESTART_FAILURES", &cfg.DBPoolRestartFailures, 0},
+		{"DB_QUERY_ATTEMPTS", &cfg.DBQueryAttempts, 1},
+	} {
+		if *setting.value, err = intFromEnv(setting.name, *setting.value, setting.minValue); err != nil {
+			return Config{}, fmt.Errorf("invalid %s env variable: %w", setting.name, err)
+		}
+	}
+	maxBodyBytes, err := intFromEnv("MAX_BODY_BYTES", int(cfg.MaxBodyBytes), 1)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid MAX_BODY_BYTES env variable: %w", err)
+	}
+	cfg.MaxBodyBytes = int64(maxBodyBytes)
+	if cfg.PoolMaxConns > math.MaxInt32 {
+		return Config{}, fmt.Errorf(
+			"invalid POOL_MAX_CONNS env variable: it must be at most %d, got %d", math.MaxInt32, cfg.PoolMaxConns,
+		)
+	}
+	if cfg.PoolMaxConns > 0 && cfg.PoolMinConns > cfg.PoolMaxConns {
+		return Config{}, fmt.Errorf(
+			"invalid POOL_MIN_CONNS env variable: it must not be greater than POOL_MAX_CONNS(%d), got %d",
+			cfg.PoolMaxConns, cfg.PoolMinConns,
+		)
+	}
+	if cfg.RateLimitRPS, err = floatFromEnv("RATE_LIMIT_RPS", cfg.RateLimitRPS); err != nil {
+		return Config{}, fmt.Errorf("invalid RATE_LIMIT_RPS env variable: %w", err)
+	}
+	if cfg.RateLimitBurst, err = intFromEnv("RATE_LIMIT_BURST", int(math.Ceil(cfg.RateLimitRPS)), 1); err != nil {
+		return Config{}, fmt.Errorf("invalid RATE_LIMIT_BURST env variable: %w", err)
+	}
+	if conflictStatus := os.Getenv("CONFLICT_STATUS"); conflictStatus != "" {
+		cfg.ConflictStatus, err = strconv.Atoi(conflictStatus)
+		if err != nil || (cfg.ConflictStatus != http.StatusOK && cfg.ConflictStatus != http.StatusConflict) {
+			return Config{}, fmt.Errorf("invalid CONFLICT_STATUS env variable: expected one of 200, 409, got %q", conflictStatus)
+		}
+	}
+
+	for _, setting := range []struct {
+		name  string
+		value *bool
+	}{
+		{"ENABLE_H2C", &cfg.EnableH2C},
+		{"PRETTY_JSON", &cfg.PrettyJSON},
+		{"ENABLE_PPROF", &cfg.EnablePprof},
+		{"ENABLE_DEBUG_CONFIG", &cfg.EnableDebugConfig},
+		{"ALLOW_TRUNCATE", &cfg.AllowTruncate},
+		{"PGBOUNCER_MODE", &cfg.PgBouncerMode},
+	} {
+		if *setting.value, err = boolFromEnv(setting.name, *setting.value); err != nil {
+			return Config{}, fmt.Errorf("invalid %s env variable: %w", setting.name, err)
+		}
+	}
+
+	cfg.DatabaseURL, cfg.DatabaseReplicaURL = os.Getenv("DATABASE_URL"), os.Getenv("DATABASE_REPLICA_URL")
+	// PgBouncer rejects statement_timeout startup parameter, unless it's listed in its ignore_startup_parameters,
+	// so the default one isn't sent in PgBouncer mode
+	if cfg.PgBouncerMode {
+		cfg.DBStatementTimeout = 0
+	}
+	for _, setting := range []struct {
+		name      string
+		value     *time.Duration
+		allowZero bool
+	}{
+		{"SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout, false},
+		{"REQUEST_TIMEOUT", &cfg.RequestTimeout, true},
+		{"SERVER_READ_TIMEOUT", &cfg.ServerReadTimeout, true},
+		{"SERVER_WRITE_TIMEOUT", &cfg.ServerWriteTimeout, true},
+		{"SERVER_IDLE_TIMEOUT", &cfg.ServerIdleTimeout, true},
+		{"IDEMPOTENCY_WINDOW", &cfg.IdempotencyWindow, false},
+		{"EXPIRY_SWEEP_INTERVAL", &cfg.ExpirySweepInterval, false},
+		{"HEALTH_CHECK_INTERVAL", &cfg.HealthCheckInterval, false},
+		{"POOL_MAX_CONN_LIFETIME", &cfg.PoolMaxConnLifetime, false},
+		{"POOL_MAX_CONN_IDLE_TIME", &cfg.PoolMaxConnIdleTime, false},
+		{"DB_STATEMENT_TIMEOUT", &cfg.DBStatementTimeout, true},
+		{"DB_ACQUIRE_TIMEOUT", &cfg.DBAcquireTimeout, false},
+		{"DB_CONNECT_RETRY_DELAY", &cfg.DBConnectRetryDelay, false},
+		{"SLOW_QUERY_THRESHOLD", &cfg.SlowQueryThreshold, true},
+	} {
+		readDuration := durationFromEnv
+		if setting.allowZero {
+			readDuration = durationOrZeroFromEnv
+		}
+		if *setting.value, err = readDuration(setting.name, *setting.value); err != nil {
+			return Config{}, fmt.Errorf("invalid %s env variable: %w", setting.name, err)
+		}
+	}
+	cfg.DBStatementTimeoutExplicit = os.Getenv("DB_STATEMENT_TIMEOUT") != ""
+	if cfg.PgBouncerMode && cfg.DBStatementTimeout > 0 {
+		return Config{}, errors.New(
+			"DB_STATEMENT_TIMEOUT env variable can't be used with PGBOUNCER_MODE, set statement_timeout of DB role instead",
+		)
+	}
+
+	if cfg.APIPrefix, err = parseAPIPrefix(os.Getenv("API_PREFIX")); err != nil {
+		return Config{}, fmt.Errorf("invalid API_PREFIX env variable: %w", err)
+	}
+	port, err := intFromEnv("PORT", int(cfg.Port), 1)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid PORT env variable: %w", err)
+	}
+	if port > math.MaxUint16 {
+		return Config{}, fmt.Errorf("invalid PORT env variable: it must be at most %d, got %d", math.MaxUint16, port)
+	}
+	cfg.Port = uint16(port)
+	cfg.BindAddress = os.Getenv("BIND_ADDRESS")
+	if _, err = listenAddress(cfg.BindAddress, cfg.Port); err != nil {
+		return Config{}, fmt.Errorf("invalid BIND_ADDRESS env variable: %w", err)
+	}
+	cfg.TLSCertFile, cfg.TLSKeyFile = os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if err = checkTLSFiles(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+		return Config{}, fmt.Errorf("invalid TLS_CERT_FILE and TLS_KEY_FILE env variables: %w", err)
+	}
+	cfg.CORSAllowedOrigins = listFromEnv("CORS_ALLOWED_ORIGINS")
+	if cfg.TrustedProxies, err = parseTrustedProxies(listFromEnv("TRUSTED_PROXIES")); err != nil {
+		return Config{}, fmt.Errorf("invalid TRUSTED_PROXIES env variable: %w", err)
+	}
+	if contentTypes := listFromEnv("ALLOWED_CONTENT_TYPES"); len(contentTypes) > 0 {
+		cfg.AllowedContentTypes = nil
+		for _, contentType := range contentTypes {
+			cfg.AllowedContentTypes = append(cfg.AllowedContentTypes, strings.ToLower(contentType))
+		}
+	}
+	cfg.APIKey = os.Getenv("API_KEY")
+	cfg.OTLPEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	cfg.WebhookURL = os.Getenv("WEBHOOK_URL")
+	cfg.KafkaBrokers, cfg.KafkaTopic = listFromEnv("KAFKA_BROKERS"), os.Getenv("KAFKA_TOPIC")
+	if (len(cfg.KafkaBrokers) > 0) != (cfg.KafkaTopic != "") {
+		return Config{}, errors.New("KAFKA_BROKERS and KAFKA_TOPIC env variables must be set together")
+	}
+	if driver := os.Getenv("DB_DRIVER"); driver != "" {
+		cfg.DBDriver = driver
+	}
+	if cfg.DBDriver != "postgres" && cfg.DBDriver != "sqlite" {
+		return Config{}, fmt.Errorf("invalid DB_DRIVER env variable: expected one of postgres, sqlite, got %q", cfg.DBDriver)
+	}
+	if path := os.Getenv("SQLITE_PATH"); path != "" {
+		cfg.SQLitePath = path
+	}
+	return cfg, nil
+}
+
+// migrationsFS PostgreSQL migrations, every file is named <version>_<description>.sql.
+// Statements of migrations are idempotent, so they work for DBs created before migrations were introduced.
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// openAPISpec OpenAPI 3 document describing the API, it's served at /openapi.json.
+// Tests check that it lists every registered route, so the document doesn't drift from the router.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// migrationsLockKey key of PostgreSQL advisory lock, which prevents concurrent migrations by several app instances
+const migrationsLockKey = 4242
+
+// migration single DB schema change
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations reads migrations from *.sql files in dir of fsys, and returns them ordered by version
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	var migrations []migration
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		rawVersion, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(rawVersion)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s must start with a positive version number", entry.Name())
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: name, sql: string(content)})
+	}
+	slices.SortFunc(migrations, func(a, b migration) int { return a.version - b.version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", migrations[i-1].name, migrations[i].name)
+		}
+	}
+	return migrations, nil
+}
+
+// runMigrations applies migrations which weren't applied yet, every one in its own transaction,
+// and records their versions in schema_migrations table. It returns number of applied migrations.
+// Every transaction takes transaction-level advisory lock and checks that its migration is still pending,
+// so concurrent app instances don't apply it twice. Session-level lock isn't used, because behind PgBouncer
+// in transaction pooling mode its lock and unlock may run on different server connections and leak it.
+func runMigrations(ctx context.Context, dbPool *pgxpool.Pool, migrations []migration) (int, error) {
+	err := pgx.BeginFunc(ctx, dbPool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationsLockKey); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version integer PRIMARY KEY,
+			name text NOT NULL,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, m := range migrations {
+		var isApplied bool
+		err = pgx.BeginFunc(ctx, dbPool, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationsLockKey); err != nil {
+				return err
+			}
+			err := tx.QueryRow(
+				ctx, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", m.version,
+			).Scan(&isApplied)
+			if err != nil || isApplied {
+				return err
+			}
+			if _, err := tx.Exec(ctx, m.sql); err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.version, m.name)
+			return err
+		})
+		if err != nil {
+			return applied, fmt.Errorf("failed to apply migration %s: %w", m.name, err)
+		}
+		if isApplied {
+			continue
+		}
+		slog.Info("Migration applied", slog.String("migration", m.name))
+		applied++
+	}
+	return applied, nil
+}
+
+// initDBStructure brings DB structure up to date by applying embedded migrations
+func initDBStructure(ctx context.Context, dbPool *pgxpool.Pool) error {
+	migrations, err := loadMigrations(migrationsFS, "migrations")
+	if err != nil {
+		return err
+	}
+	if _, err = runMigrations(ctx, dbPool, migrations); err != nil {
+		return err
+	}
+	slog.Info("Database structure initialized")
+	return nil
+}
+
+// ErrItemNotFound is returned by Store when requested item doesn't exist
+var ErrItemNotFound = errors.New("item not found")
+
+// ErrStoreBusy is returned by Store when it has no free DB connection to serve the call in time
+var ErrStoreBusy = errors.New("no free database connection")
+
+// Store keeps items, handlers work with it instead of DB directly,
+// so they can be tested without real database.
+type Store interface {
+	// Ping checks that store is reachable
+	Ping(ctx context.Context) error
+	// Get returns item by ID or ErrItemNotFound
+	Get(ctx context.Context, itemID string) (StoredItem, error)
+	// GetMany returns values of items with given IDs, missing items are omitted from the result
+	GetMany(ctx context.Context, itemIDs []string) (map[string]Item, error)
+	// Exists checks that item exists without reading its value, it returns ErrItemNotFound for missing item
+	Exists(ctx context.Context, itemID string) error
+	// Put inserts a new item. If item with the same ID already exists,
+	// it doesn't change anything and returns false as the second value.
+	Put(ctx context.Context, item Item) (StoredItem, bool, error)
+	// Upsert inserts a new item or replaces value and TTL of existing one.
+	// It returns true as the second value if item was inserted.
+	Upsert(ctx context.Context, item Item) (StoredItem, bool, error)
+	// Update changes value of existing item or returns ErrItemNotFound
+	Update(ctx context.Context, itemID string, update ItemUpdate) error
+	// CompareAndUpdate changes value of existing item only if its current value and attributes are equal to current,
+	// otherwise it returns ErrItemNotFound
+	CompareAndUpdate(ctx context.Context, itemID string, current ItemUpdate, update ItemUpdate) error
+	// Delete soft-deletes item by ID or returns ErrItemNotFound. Soft-deleted items are invisible for
+	// other methods, except List with includeDeleted, and they are replaced by Put as if they don't exist.
+	Delete(ctx context.Context, itemID string) error
+	// DeleteMany soft-deletes items with given IDs the same way as Delete, missing items are skipped.
+	// It returns number of deleted items.
+	DeleteMany(ctx context.Context, itemIDs []string) (int, error)
+	// List returns a page of items ordered by ID, which IDs start with prefix, empty prefix matches all items.
+	// Only items with IDs greater than after are returned, empty after starts from the first item, so pages
+	// don't skip or repeat items under concurrent writes the way offset does.
+	// Soft-deleted items are included only if includeDeleted is true.
+	List(ctx context.Context, limit int, offset int, after string, prefix string, includeDeleted bool) ([]Item, error)
+	// Count returns number of items
+	Count(ctx context.Context) (int, error)
+	// Search returns up to limit items ordered by ID, which values contain query, ignoring case
+	Search(ctx context.Context, query string, limit int) ([]Item, error)
+	// Export calls fn for every item ordered by ID, reading them one by one instead of loading all at once.
+	// It stops and returns the error if fn returns an error.
+	Export(ctx context.Context, fn func(StoredItem) error) error
+	// BulkPut inserts items in a single transaction, skipping items which already exist.
+	// It returns number of inserted items.
+	BulkPut(ctx context.Context, items []Item) (int, error)
+	// BulkUpsert inserts items or replaces values and TTL of existing ones in a single transaction
+	BulkUpsert(ctx context.Context, items []Item) error
+	// DeleteAll removes all items, including soft-deleted ones, and returns number of removed items
+	DeleteAll(ctx context.Context) (int, error)
+	// DeleteExpired removes items with expired TTL and returns number of removed items.
+	// Expired items are invisible for other methods even before they are removed.
+	DeleteExpired(ctx context.Context) (int, error)
+	// PoolStats returns current state of DB connections pool
+	PoolStats() PoolStats
+	// PendingMigrations returns number of embedded migrations which aren't applied to DB, it isn't 0 when
+	// DB schema doesn't match the app, e.g. after it was restored from a backup made before a deploy
+	PendingMigrations(ctx context.Context) (int, error)
+}
+
+// PoolStats numbers of DB connections in the pool
+type PoolStats struct {
+	AcquiredConns int `json:"acquired_conns"`
+	IdleConns     int `json:"idle_conns"`
+	TotalConns    int `json:"total_conns"`
+	MaxConns      int `json:"max_conns"`
+}
+
+// pgNotExpired SQL condition which filters out expired items
+const pgNotExpired = "(expires_at IS NULL OR expires_at > now())"
+
+// pgVisible SQL condition which filters out expired and soft-deleted items
+const pgVisible = "deleted_at IS NULL AND " + pgNotExpired
+
+// pgInsertItem SQL statement which inserts a new item with optional TTL in seconds.
+// Expired item, which wasn't removed yet, and soft-deleted item are replaced as if they don't exist.
+const pgInsertItem = `INSERT INTO data (id, value, value_is_json, expires_at, attributes)
+	VALUES ($1, $2, $3, now() + $4::int * interval '1 second', $5::jsonb)
+	ON CONFLICT (id) DO UPDATE
+	SET value = EXCLUDED.value, value_is_json = EXCLUDED.value_is_json, attributes = EXCLUDED.attributes,
+		created_at = now(), updated_at = now(), expires_at = EXCLUDED.expires_at, deleted_at = NULL
+	WHERE data.expires_at <= now() OR data.deleted_at IS NOT NULL`
+
+// pgUpsertItem SQL statement which inserts a new item or replaces value and TTL of existing one.
+// xmax is 0 only for inserted rows. Expired item, which wasn't removed yet, and soft-deleted item get
+// new created_at, so it's equal to updated_at, and they are reported as inserted too.
+const pgUpsertItem = `INSERT INTO data (id, value, value_is_json, expires_at, attributes)
+	VALUES ($1, $2, $3, now() + $4::int * interval '1 second', $5::jsonb)
+	ON CONFLICT (id) DO UPDATE
+	SET value = EXCLUDED.value, value_is_json = EXCLUDED.value_is_json, attributes = EXCLUDED.attributes,
+		updated_at = now(),
+		expires_at = EXCLUDED.expires_at, deleted_at = NULL,
+		created_at = CASE WHEN data.expires_at <= now() OR data.deleted_at IS NOT NULL
+			THEN now() ELSE data.created_at END
+	RETURNING created_at, updated_at, expires_at, (xmax = 0 OR created_at = updated_at) AS inserted`
+
+// nullableTTL returns nil for TTL which isn't set, so it's passed to DB as NULL
+func nullableTTL(ttlSeconds int) any {
+	if ttlSeconds == 0 {
+		return nil
+	}
+	return ttlSeconds
+}
+
+// txBeginner starts transactions, it's implemented by pgxpool.Pool and pgxpool.Conn
+type txBeginner interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// withTx runs fn in a transaction of db, so multi-step writes are applied all together or not at all.
+// The transaction is committed when fn succeeds, and rolled back when fn returns error or panics, the panic
+// is re-raised after rollback. Rollback ignores cancellation of ctx, so a canceled request can't skip it.
+func withTx(ctx context.Context, db txBeginner, fn func(tx pgx.Tx) error) (err error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			_ = tx.Rollback(context.WithoutCancel(ctx))
+			panic(recovered)
+		}
+		if err != nil { // it does nothing if commit failed, because then transaction is already closed
+			_ = tx.Rollback(context.WithoutCancel(ctx))
+		}
+	}()
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// escapeLike escapes LIKE pattern special characters in s, so it's matched literally.
+// Backslash is the default escape character in PostgreSQL, SQLite queries set it explicitly.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// pgStore Store implementation which keeps items in PostgreSQL
+type pgStore struct {
+	// dbPool is replaced by RestartPool, so it's loaded for every call
+	dbPool atomic.Pointer[pgxpool.Pool]
+	// acquireTimeout how long a store call waits for a free connection from the pool
+	acquireTimeout time.Duration
+	// mu guards replacing and closing of the pool
+	mu     sync.Mutex
+	closed bool
+	// oldPools tracks closing of pools replaced by RestartPool, Close waits for them, so shutdown waits for them
+	// the same way as for the current pool
+	oldPools sync.WaitGroup
+}
+
+// newPgStore creates pgStore which uses dbPool, waiting for a free connection not longer than acquireTimeout
+func newPgStore(dbPool *pgxpool.Pool, acquireTimeout time.Duration) *pgStore {
+	store := &pgStore{acquireTimeout: acquireTimeout}
+	store.dbPool.Store(dbPool)
+	return store
+}
+
+// pool returns current connection pool
+func (s *pgStore) pool() *pgxpool.Pool {
+	return s.dbPool.Load()
+}
+
+// RestartPool replaces connection pool with a new one which has the same config, e.g. to drop broken connections
+// after DB failover. The old pool is closed in background once in-flight queries release their connections.
+func (s *pgStore) RestartPool(ctx context.Context) error {
+	newPool, err := pgxpool.NewWithConfig(ctx, s.pool().Config())
+	if err != nil {
+		return err
+	}
+	if err = newPool.Ping(ctx); err != nil {
+		newPool.Close()
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed { // app is shutting down, nobody would close the new pool
+		newPool.Close()
+		return errors.New("store is closed")
+	}
+	oldPool := s.dbPool.Swap(newPool)
+	s.oldPools.Add(1)
+	go func() {
+		defer s.oldPools.Done()
+		oldPool.Close() // Close waits until all acquired connections are released
+		slog.Info("Old DB connection pool is closed")
+	}()
+	return nil
+}
+
+// Close closes current connection pool and waits for pools replaced by RestartPool to close,
+// it waits until all acquired connections are released
+func (s *pgStore) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.pool().Close()
+	s.oldPools.Wait()
+}
+
+// acquire takes a connection from the pool for a single store call, waiting for a free one not longer
+// than acquireTimeout. If pool stays exhausted, it returns ErrStoreBusy instead of waiting for the whole
+// request context. Caller must release the connection.
+func (s *pgStore) acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	acquireCtx, cancel := context.WithTimeout(ctx, s.acquireTimeout)
+	defer cancel()
+	conn, err := s.pool().Acquire(acquireCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(acquireCtx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%w: %w", ErrStoreBusy, err)
+	}
+	return conn, err
+}
+
+func (s *pgStore) Ping(ctx context.Context) error {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	return conn.Ping(ctx)
+}
+
+func (s *pgStore) Get(ctx context.Context, itemID string) (StoredItem, error) {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return StoredItem{}, err
+	}
+	defer conn.Release()
+	item := StoredItem{Item: Item{ItemId: itemID}}
+	err = conn.QueryRow(
+		ctx,
+		"SELECT value, value_is_json, attributes, created_at, updated_at, expires_at FROM data WHERE id = $1 AND "+pgVisible,
+		itemID,
+	).Scan(&item.Value, &item.ValueIsJSON, &item.Attributes, &item.CreatedAt, &item.UpdatedAt, &item.ExpiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return StoredItem{}, ErrItemNotFound
+	}
+	return item, err
+}
+
+func (s *pgStore) GetMany(ctx context.Context, itemIDs []string) (map[string]Item, error) {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	rows, err := conn.Query(
+		ctx,
+		"SELECT id, value, value_is_json FROM data WHERE id = ANY($1) AND "+pgVisible,
+		itemIDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	items, err := pgx.CollectRows(rows, pgx.RowToStructByPos[Item])
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]Item, len(items))
+	for _, item := range items {
+		found[item.ItemId] = item
+	}
+	return found, nil
+}
+
+func (s *pgStore) Exists(ctx context.Context, itemID string) error {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	var found int
+	err = conn.QueryRow(ctx, "SELECT 1 FROM data WHERE id = $1 AND "+pgVisible, itemID).Scan(&found)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrItemNotFound
+	}
+	return err
+}
+
+func (s *pgStore) Put(ctx context.Context, item Item) (StoredItem, bool, error) {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return StoredItem{}, false, err
+	}
+	defer conn.Release()
+	storedItem := StoredItem{Item: item}
+	err = conn.QueryRow(
+		ctx,
+		pgInsertItem+" RETURNING created_at, updated_at, expires_at",
+		item.ItemId, item.Value, item.ValueIsJSON, nullableTTL(item.TTLSeconds), item.Attributes.jsonText(),
+	).Scan(&storedItem.CreatedAt, &storedItem.UpdatedAt, &storedItem.ExpiresAt)
+	if errors.Is(err, pgx.ErrNoRows) { // item already exists, nothing was inserted
+		return StoredItem{}, false, nil
+	}
+	if err != nil {
+		return StoredItem{}, false, err
+	}
+	return storedItem, true, nil
+}
+
+func (s *pgStore) Upsert(ctx context.Context, item Item) (StoredItem, bool, error) {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return StoredItem{}, false, err
+	}
+	defer conn.Release()
+	storedItem := StoredItem{Item: item}
+	var inserted bool
+	err = conn.QueryRow(
+		ctx,
+		pgUpsertItem,
+		item.ItemId, item.Value, item.ValueIsJSON, nullableTTL(item.TTLSeconds), item.Attributes.jsonText(),
+	).Scan(&storedItem.CreatedAt, &storedItem.UpdatedAt, &storedItem.ExpiresAt, &inserted)
+	if err != nil {
+		return StoredItem{}, false, err
+	}
+	return storedItem, inserted, nil
+}
+
+func (s *pgStore) Update(ctx context.Context, itemID string, update ItemUpdate) error {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	res, err := conn.Exec(
+		ctx,
+		`UPDATE data SET value = $2, value_is_json = $3, attributes = COALESCE($4::jsonb, attributes), updated_at = now()
+		WHERE id = $1 AND `+pgVisible,
+		itemID, update.Value, update.ValueIsJSON, nullableAttributes(update.Attributes),
+	)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrItemNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) CompareAndUpdate(ctx context.Context, itemID string, current ItemUpdate, update ItemUpdate) error {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	res, err := conn.Exec(
+		ctx,
+		`UPDATE data SET value = $2, value_is_json = $3, attributes = COALESCE($6::jsonb, attributes), updated_at = now()
+		WHERE id = $1 AND value = $4 AND value_is_json = $5 AND attributes = $7::jsonb AND `+pgVisible,
+		itemID, update.Value, update.ValueIsJSON, current.Value, current.ValueIsJSON, nullableAttributes(update.Attributes),
+		current.Attributes.jsonText(),
+	)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrItemNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) Delete(ctx context.Context, itemID string) error {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	res, err := conn.Exec(ctx, "UPDATE data SET deleted_at = now() WHERE id = $1 AND "+pgVisible, itemID)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrItemNotFound
+	}
+	return nil
+}
+
+func (s *pgStore) DeleteMany(ctx context.Context, itemIDs []string) (int, error) {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	res, err := conn.Exec(ctx, "UPDATE data SET deleted_at = now() WHERE id = ANY($1) AND "+pgVisible, itemIDs)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.RowsAffected()), nil
+}
+
+func (s *pgStore) List(
+	ctx context.Context,
+	limit int,
+	offset int,
+	after string,
+	prefix string,
+	includeDeleted bool,
+) ([]Item, error) {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	condition := pgVisible
+	if includeDeleted {
+		condition = pgNotExpired
+	}
+	// "C" collation orders IDs byte-wise, the same way as SQLite and Go do. IDs aren't empty,
+	// so empty after matches all of them.
+	rows, err := conn.Query(
+		ctx,
+		`SELECT id, value, value_is_json FROM data WHERE id LIKE $3 || '%' AND id COLLATE "C" > $4 AND `+condition+
+			` ORDER BY id COLLATE "C" LIMIT $1 OFFSET $2`,
+		limit, offset, escapeLike(prefix), after,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[Item])
+}
+
+func (s *pgStore) Count(ctx context.Context) (int, error) {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	var count int
+	err = conn.QueryRow(ctx, "SELECT count(*) FROM data WHERE "+pgVisible).Scan(&count)
+	return count, err
+}
+
+func (s *pgStore) Search(ctx context.Context, query string, limit int) ([]Item, error) {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	rows, err := conn.Query(
+		ctx,
+		`SELECT id, value, value_is_json FROM data WHERE value ILIKE '%' || $1 || '%' AND `+pgVisible+
+			` ORDER BY id COLLATE "C" LIMIT $2`,
+		escapeLike(query), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[Item])
+}
+
+func (s *pgStore) Export(ctx context.Context, fn func(StoredItem) error) error {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	rows, err := conn.Query(
+		ctx,
+		`SELECT id, value, value_is_json, attributes, created_at, updated_at, expires_at FROM data WHERE `+pgVisible+
+			` ORDER BY id COLLATE "C"`,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item StoredItem
+		err := rows.Scan(
+			&item.ItemId, &item.Value, &item.ValueIsJSON, &item.Attributes, &item.CreatedAt, &item.UpdatedAt, &item.ExpiresAt,
+		)
+		if err != nil {
+			return err
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *pgStore) BulkPut(ctx context.Context, items []Item) (int, error) {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	batch := &pgx.Batch{}
+	for _, item := range items {
+		batch.Queue(pgInsertItem, item.ItemId, item.Value, item.ValueIsJSON, nullableTTL(item.TTLSeconds),
+			item.Attributes.jsonText(),
+		)
+	}
+	created := 0
+	err = withTx(ctx, conn, func(tx pgx.Tx) error {
+		results := tx.SendBatch(ctx, batch)
+		for range items {
+			res, err := results.Exec()
+			if err != nil {
+				_ = results.Close()
+				return err
+			}
+			created += int(res.RowsAffected())
+		}
+		return results.Close()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return created, nil
+}
+
+func (s *pgStore) BulkUpsert(ctx context.Context, items []Item) error {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	batch := &pgx.Batch{}
+	for _, item := range items {
+		batch.Queue(pgUpsertItem, item.ItemId, item.Value, item.ValueIsJSON, nullableTTL(item.TTLSeconds),
+			item.Attributes.jsonText(),
+		)
+	}
+	return withTx(ctx, conn, func(tx pgx.Tx) error {
+		return tx.SendBatch(ctx, batch).Close()
+	})
+}
+
+func (s *pgStore) DeleteExpired(ctx context.Context) (int, error) {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	res, err := conn.Exec(ctx, "DELETE FROM data WHERE expires_at < now()")
+	if err != nil {
+		return 0, err
+	}
+	return int(res.RowsAffected()), nil
+}
+
+func (s *pgStore) DeleteAll(ctx context.Context) (int, error) {
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	// TRUNCATE doesn't report number of removed rows, so we use DELETE
+	res, err := conn.Exec(ctx, "DELETE FROM data")
+	if err != nil {
+		return 0, err
+	}
+	return int(res.RowsAffected()), nil
+}
+
+func (s *pgStore) PoolStats() PoolStats {
+	stat := s.pool().Stat()
+	return PoolStats{
+		AcquiredConns: int(stat.AcquiredConns()),
+		IdleConns:     int(stat.IdleConns()),
+		TotalConns:    int(stat.TotalConns()),
+		MaxConns:      int(stat.MaxConns()),
+	}
+}
+
+func (s *pgStore) PendingMigrations(ctx context.Context) (int, error) {
+	migrations, err := loadMigrations(migrationsFS, "migrations")
+	if err != nil {
+		return 0, err
+	}
+	conn, err := s.acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+	rows, err := conn.Query(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "42P01" { // undefined_table, no migrations were applied
+			return len(migrations), nil
+		}
+		return 0, err
+	}
+	appliedVersions, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return 0, err
+	}
+	pending := 0
+	for _, m := range migrations {
+		if !slices.Contains(appliedVersions, m.version) {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+// cachedStore Store decorator which serves Get from in-memory LRU cache of recently read items.
+// Writes go to the underlying store and invalidate cached item with the same ID. Misses are read from
+// the primary store, because a lagging replica value would stay in the cache until the next write of the item.
+type cachedStore struct {
+	Store
+	size    int
+	mu      sync.Mutex
+	entries map[string]*list.Element // values of list elements are StoredItem
+	lru     *list.List               // the most recently used items are in the front
+	version uint64                   // incremented on every invalidation, protects cache from stale reads
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+}
+
+func newCachedStore(store Store, size int) *cachedStore {
+	return &cachedStore{
+		Store:   store,
+		size:    size,
+		entries: make(map[string]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+func (s *cachedStore) Get(ctx context.Context, itemID string) (StoredItem, error) {
+	if isPrimaryRead(ctx) {
+		return s.Store.Get(ctx, itemID)
+	}
+	s.mu.Lock()
+	if element, ok := s.entries[itemID]; ok {
+		if !element.Value.(StoredItem).expired(time.Now()) {
+			s.lru.MoveToFront(element)
+			s.mu.Unlock()
+			s.hits.Add(1)
+			return element.Value.(StoredItem), nil
+		}
+		s.lru.Remove(element) // expired item could be replaced in the store, so we read it again
+		delete(s.entries, itemID)
+	}
+	version := s.version
+	s.mu.Unlock()
+	s.misses.Add(1)
+
+	item, err := s.Store.Get(withPrimaryRead(ctx), itemID)
+	if err != nil {
+		return item, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// don't cache the item if it was changed while we were reading it
+	if _, ok := s.entries[itemID]; !ok && version == s.version {
+		s.entries[itemID] = s.lru.PushFront(item)
+		if s.lru.Len() > s.size {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.entries, oldest.Value.(StoredItem).ItemId)
+		}
+	}
+	return item, nil
+}
+
+func (s *cachedStore) Exists(ctx context.Context, itemID string) error {
+	s.mu.Lock()
+	element, ok := s.entries[itemID]
+	s.mu.Unlock()
+	if ok && !element.Value.(StoredItem).expired(time.Now()) {
+		return nil
+	}
+	return s.Store.Exists(ctx, itemID)
+}
+
+func (s *cachedStore) Put(ctx context.Context, item Item) (StoredItem, bool, error) {
+	defer s.invalidate(item.ItemId)
+	return s.Store.Put(ctx, item)
+}
+
+func (s *cachedStore) Upsert(ctx context.Context, item Item) (StoredItem, bool, error) {
+	defer s.invalidate(item.ItemId)
+	return s.Store.Upsert(ctx, item)
+}
+
+func (s *cachedStore) Update(ctx context.Context, itemID string, update ItemUpdate) error {
+	defer s.invalidate(itemID)
+	return s.Store.Update(ctx, itemID, update)
+}
+
+func (s *cachedStore) CompareAndUpdate(ctx context.Context, itemID string, current ItemUpdate, update ItemUpdate) error {
+	defer s.invalidate(itemID)
+	return s.Store.CompareAndUpdate(ctx, itemID, current, update)
+}
+
+func (s *cachedStore) Delete(ctx context.Context, itemID string) error {
+	defer s.invalidate(itemID)
+	return s.Store.Delete(ctx, itemID)
+}
+
+func (s *cachedStore) DeleteMany(ctx context.Context, itemIDs []string) (int, error) {
+	defer func() {
+		for _, itemID := range itemIDs {
+			s.invalidate(itemID)
+		}
+	}()
+	return s.Store.DeleteMany(ctx, itemIDs)
+}
+
+func (s *cachedStore) BulkPut(ctx context.Context, items []Item) (int, error) {
+	defer func() {
+		for _, item := range items {
+			s.invalidate(item.ItemId)
+		}
+	}()
+	return s.Store.BulkPut(ctx, items)
+}
+
+func (s *cachedStore) BulkUpsert(ctx context.Context, items []Item) error {
+	defer func() {
+		for _, item := range items {
+			s.invalidate(item.ItemId)
+		}
+	}()
+	return s.Store.BulkUpsert(ctx, items)
+}
+
+func (s *cachedStore) DeleteAll(ctx context.Context) (int, error) {
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.version++
+		clear(s.entries)
+		s.lru.Init()
+	}()
+	return s.Store.DeleteAll(ctx)
+}
+
+// invalidate removes item from the cache
+func (s *cachedStore) invalidate(itemID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+	if element, ok := s.entries[itemID]; ok {
+		s.lru.Remove(element)
+		delete(s.entries, itemID)
+	}
+}
+
+// Stats returns number of Get calls served from the cache and from the underlying store
+func (s *cachedStore) Stats() (hits uint64, misses uint64) {
+	return s.hits.Load(), s.misses.Load()
+}
+
+// primaryReadContextKey key of context value which makes reads go to the primary store
+type primaryReadContextKey struct{}
+
+// withPrimaryRead returns ctx which makes splitStore read from the primary store and cachedStore skip its cache.
+// Conditional writes read with it, because lagging replica can still return the value which was already changed.
+func withPrimaryRead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadContextKey{}, true)
+}
+
+// isPrimaryRead checks if reads with ctx must go to the primary store
+func isPrimaryRead(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryReadContextKey{}).(bool)
+	return primary
+}
+
+// splitStore Store decorator which sends reads to the replica store and everything else to the primary one.
+// Reads with withPrimaryRead context go to the primary store too.
+type splitStore struct {
+	Store
+	replica Store
+}
+
+// RestartPool restarts pools of both stores, DB failover usually affects both of them
+func (s *splitStore) RestartPool(ctx context.Context) error {
+	var errs []error
+	for _, store := range []Store{s.Store, s.replica} {
+		if restarter, ok := store.(poolRestarter); ok {
+			errs = append(errs, restarter.RestartPool(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Ping checks both primary and replica stores, app isn't ready if any of them is unreachable
+func (s *splitStore) Ping(ctx context.Context) error {
+	return errors.Join(s.Store.Ping(ctx), s.replica.Ping(ctx))
+}
+
+func (s *splitStore) Get(ctx context.Context, itemID string) (StoredItem, error) {
+	if isPrimaryRead(ctx) {
+		return s.Store.Get(ctx, itemID)
+	}
+	return s.replica.Get(ctx, itemID)
+}
+
+func (s *splitStore) GetMany(ctx context.Context, itemIDs []string) (map[string]Item, error) {
+	if isPrimaryRead(ctx) {
+		return s.Store.GetMany(ctx, itemIDs)
+	}
+	return s.replica.GetMany(ctx, itemIDs)
+}
+
+func (s *splitStore) Exists(ctx context.Context, itemID string) error {
+	if isPrimaryRead(ctx) {
+		return s.Store.Exists(ctx, itemID)
+	}
+	return s.replica.Exists(ctx, itemID)
+}
+
+func (s *splitStore) List(
+	ctx context.Context,
+	limit int,
+	offset int,
+	after string,
+	prefix string,
+	includeDeleted bool,
+) ([]Item, error) {
+	return s.replica.List(ctx, limit, offset, after, prefix, includeDeleted)
+}
+
+func (s *splitStore) Count(ctx context.Context) (int, error) {
+	return s.replica.Count(ctx)
+}
+
+func (s *splitStore) Search(ctx context.Context, query string, limit int) ([]Item, error) {
+	return s.replica.Search(ctx, query, limit)
+}
+
+func (s *splitStore) Export(ctx context.Context, fn func(StoredItem) error) error {
+	return s.replica.Export(ctx, fn)
+}
+
+// tracingStore Store decorator which creates a span for every store call,
+// spans are children of the request span taken from the context.
+type tracingStore struct {
+	Store
+	tracer trace.Tracer
+}
+
+// startSpan starts a client span for store operation
+func (s *tracingStore) startSpan(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return s.tracer.Start(
+		ctx,
+		"store."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBOperationName(operation)),
+	)
+}
+
+// endSpan records store error, if any, and ends the span. Not found item isn't considered as an error.
+func endSpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, ErrItemNotFound) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s *tracingStore) Ping(ctx context.Context) (err error) {
+	ctx, span := s.startSpan(ctx, "Ping")
+	defer func() { endSpan(span, err) }()
+	return s.Store.Ping(ctx)
+}
+
+func (s *tracingStore) Get(ctx context.Context, itemID string) (item StoredItem, err error) {
+	ctx, span := s.startSpan(ctx, "Get")
+	defer func() { endSpan(span, err) }()
+	return s.Store.Get(ctx, itemID)
+}
+
+func (s *tracingStore) GetMany(ctx context.Context, itemIDs []string) (items map[string]Item, err error) {
+	ctx, span := s.startSpan(ctx, "GetMany")
+	defer func() { endSpan(span, err) }()
+	return s.Store.GetMany(ctx, itemIDs)
+}
+
+func (s *tracingStore) Exists(ctx context.Context, itemID string) (err error) {
+	ctx, span := s.startSpan(ctx, "Exists")
+	defer func() { endSpan(span, err) }()
+	return s.Store.Exists(ctx, itemID)
+}
+
+func (s *tracingStore) Put(ctx context.Context, item Item) (storedItem StoredItem, created bool, err error) {
+	ctx, span := s.startSpan(ctx, "Put")
+	defer func() { endSpan(span, err) }()
+	return s.Store.Put(ctx, item)
+}
+
+func (s *tracingStore) Upsert(ctx context.Context, item Item) (storedItem StoredItem, inserted bool, err error) {
+	ctx, span := s.startSpan(ctx, "Upsert")
+	defer func() { endSpan(span, err) }()
+	return s.Store.Upsert(ctx, item)
+}
+
+func (s *tracingStore) Update(ctx context.Context, itemID string, update ItemUpdate) (err error) {
+	ctx, span := s.startSpan(ctx, "Update")
+	defer func() { endSpan(span, err) }()
+	return s.Store.Update(ctx, itemID, update)
+}
+
+func (s *tracingStore) CompareAndUpdate(
+	ctx context.Context,
+	itemID string,
+	current ItemUpdate,
+	update ItemUpdate,
+) (err error) {
+	ctx, span := s.startSpan(ctx, "CompareAndUpdate")
+	defer func() { endSpan(span, err) }()
+	return s.Store.CompareAndUpdate(ctx, itemID, current, update)
+}
+
+func (s *tracingStore) Delete(ctx context.Context, itemID string) (err error) {
+	ctx, span := s.startSpan(ctx, "Delete")
+	defer func() { endSpan(span, err) }()
+	return s.Store.Delete(ctx, itemID)
+}
+
+func (s *tracingStore) DeleteMany(ctx context.Context, itemIDs []string) (deleted int, err error) {
+	ctx, span := s.startSpan(ctx, "DeleteMany")
+	defer func() { endSpan(span, err) }()
+	return s.Store.DeleteMany(ctx, itemIDs)
+}
+
+func (s *tracingStore) List(
+	ctx context.Context,
+	limit int,
+	offset int,
+	after string,
+	prefix string,
+	includeDeleted bool,
+) (items []Item, err error) {
+	ctx, span := s.startSpan(ctx, "List")
+	defer func() { endSpan(span, err) }()
+	return s.Store.List(ctx, limit, offset, after, prefix, includeDeleted)
+}
+
+func (s *tracingStore) Count(ctx context.Context) (count int, err error) {
+	ctx, span := s.startSpan(ctx, "Count")
+	defer func() { endSpan(span, err) }()
+	return s.Store.Count(ctx)
+}
+
+func (s *tracingStore) Search(ctx context.Context, query string, limit int) (items []Item, err error) {
+	ctx, span := s.startSpan(ctx, "Search")
+	defer func() { endSpan(span, err) }()
+	return s.Store.Search(ctx, query, limit)
+}
+
+func (s *tracingStore) Export(ctx context.Context, fn func(StoredItem) error) (err error) {
+	ctx, span := s.startSpan(ctx, "Export")
+	defer func() { endSpan(span, err) }()
+	return s.Store.Export(ctx, fn)
+}
+
+func (s *tracingStore) BulkPut(ctx context.Context, items []Item) (created int, err error) {
+	ctx, span := s.startSpan(ctx, "BulkPut")
+	defer func() { endSpan(span, err) }()
+	return s.Store.BulkPut(ctx, items)
+}
+
+func (s *tracingStore) BulkUpsert(ctx context.Context, items []Item) (err error) {
+	ctx, span := s.startSpan(ctx, "BulkUpsert")
+	defer func() { endSpan(span, err) }()
+	return s.Store.BulkUpsert(ctx, items)
+}
+
+func (s *tracingStore) DeleteExpired(ctx context.Context) (deleted int, err error) {
+	ctx, span := s.startSpan(ctx, "DeleteExpired")
+	defer func() { endSpan(span, err) }()
+	return s.Store.DeleteExpired(ctx)
+}
+
+func (s *tracingStore) DeleteAll(ctx context.Context) (deleted int, err error) {
+	ctx, span := s.startSpan(ctx, "DeleteAll")
+	defer func() { endSpan(span, err) }()
+	return s.Store.DeleteAll(ctx)
+}
+
+// setupTracing creates tracer provider which exports spans to OTLP HTTP endpoint and registers it globally
+// together with W3C trace context propagator, so incoming trace context is picked up from request headers.
+func setupTracing(ctx context.Context, endpoint string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(tracerName))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	slog.Info("Tracing enabled", slog.String("endpoint", endpoint))
+	return tracerProvider, nil
+}
+
+// webhookQueueSize max number of notifications waiting for delivery, new ones are dropped when the queue is full
+const webhookQueueSize = 1000
+
+// webhookRetryDelay delay before the second attempt to deliver a notification, it doubles for every next attempt
+var webhookRetryDelay = time.Second
+
+// webhookNotifier sends created items to webhook URL in background with a fixed number of workers,
+// so clients don't wait for delivery
+type webhookNotifier struct {
+	url      string
+	attempts int
+	client   *http.Client
+	queue    chan StoredItem
+}
+
+// newWebhookNotifier creates notifier and starts its workers, they stop after close when the queue is drained.
+// Every delivery attempt takes not longer than timeout.
+func newWebhookNotifier(
+	url string, workers int, attempts int, timeout time.Duration, wg *sync.WaitGroup,
+) *webhookNotifier {
+	n := &webhookNotifier{
+		url:      url,
+		attempts: attempts,
+		client:   &http.Client{Timeout: timeout},
+		queue:    make(chan StoredItem, webhookQueueSize),
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range n.queue {
+				n.deliver(item)
+			}
+		}()
+	}
+	return n
+}
+
+// notify enqueues item for delivery without blocking
+func (n *webhookNotifier) notify(item StoredItem) {
+	select {
+	case n.queue <- item:
+	default:
+		slog.Warn("Webhook queue is full, notification is dropped", slog.String("item_id", item.ItemId))
+	}
+}
+
+// close stops accepting notifications, workers exit after delivering the queued ones
+func (n *webhookNotifier) close() {
+	close(n.queue)
+}
+
+// deliver sends item to webhook URL, retrying failed attempts
+func (n *webhookNotifier) deliver(item StoredItem) {
+	body, err := json.Marshal(item)
+	if err != nil {
+		slog.Error("Failed to encode webhook notification", slog.String("item_id", item.ItemId), slog.Any("error", err))
+		return
+	}
+	err = retryWithBackoff(context.Background(), n.attempts, webhookRetryDelay, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := n.client.Do(req)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("webhook responded with %d status code", resp.StatusCode)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to deliver webhook notification", slog.String("item_id", item.ItemId), slog.Any("error", err))
+	}
+}
+
+// slowQueryStore Store decorator which logs a warning for store calls taking longer than threshold
+type slowQueryStore struct {
+	Store
+	threshold time.Duration
+}
+
+// observe starts measuring store operation, returned function logs the operation if it was slow
+func (s *slowQueryStore) observe(ctx context.Context, operation string) func() {
+	start := time.Now()
+	return func() {
+		if elapsed := time.Since(start); elapsed > s.threshold {
+			slog.WarnContext(ctx, "Slow store call", slog.String("operation", operation), slog.Duration("latency", elapsed))
+		}
+	}
+}
+
+func (s *slowQueryStore) Ping(ctx context.Context) error {
+	defer s.observe(ctx, "Ping")()
+	return s.Store.Ping(ctx)
+}
+
+func (s *slowQueryStore) Get(ctx context.Context, itemID string) (StoredItem, error) {
+	defer s.observe(ctx, "Get")()
+	return s.Store.Get(ctx, itemID)
+}
+
+func (s *slowQueryStore) GetMany(ctx context.Context, itemIDs []string) (map[string]Item, error) {
+	defer s.observe(ctx, "GetMany")()
+	return s.Store.GetMany(ctx, itemIDs)
+}
+
+func (s *slowQueryStore) Exists(ctx context.Context, itemID string) error {
+	defer s.observe(ctx, "Exists")()
+	return s.Store.Exists(ctx, itemID)
+}
+
+func (s *slowQueryStore) Put(ctx context.Context, item Item) (StoredItem, bool, error) {
+	defer s.observe(ctx, "Put")()
+	return s.Store.Put(ctx, item)
+}
+
+func (s *slowQueryStore) Upsert(ctx context.Context, item Item) (StoredItem, bool, error) {
+	defer s.observe(ctx, "Upsert")()
+	return s.Store.Upsert(ctx, item)
+}
+
+func (s *slowQueryStore) Update(ctx context.Context, itemID string, update ItemUpdate) error {
+	defer s.observe(ctx, "Update")()
+	return s.Store.Update(ctx, itemID, update)
+}
+
+func (s *slowQueryStore) CompareAndUpdate(ctx context.Context, itemID string, current ItemUpdate, update ItemUpdate) error {
+	defer s.observe(ctx, "CompareAndUpdate")()
+	return s.Store.CompareAndUpdate(ctx, itemID, current, update)
+}
+
+func (s *slowQueryStore) Delete(ctx context.Context, itemID string) error {
+	defer s.observe(ctx, "Delete")()
+	return s.Store.Delete(ctx, itemID)
+}
+
+func (s *slowQueryStore) DeleteMany(ctx context.Context, itemIDs []string) (int, error) {
+	defer s.observe(ctx, "DeleteMany")()
+	return s.Store.DeleteMany(ctx, itemIDs)
+}
+
+func (s *slowQueryStore) List(
+	ctx context.Context,
+	limit int,
+	offset int,
+	after string,
+	prefix string,
+	includeDeleted bool,
+) ([]Item, error) {
+	defer s.observe(ctx, "List")()
+	return s.Store.List(ctx, limit, offset, after, prefix, includeDeleted)
+}
+
+func (s *slowQueryStore) Count(ctx context.Context) (int, error) {
+	defer s.observe(ctx, "Count")()
+	return s.Store.Count(ctx)
+}
+
+func (s *slowQueryStore) Search(ctx context.Context, query string, limit int) ([]Item, error) {
+	defer s.observe(ctx, "Search")()
+	return s.Store.Search(ctx, query, limit)
+}
+
+func (s *slowQueryStore) Export(ctx context.Context, fn func(StoredItem) error) error {
+	defer s.observe(ctx, "Export")()
+	return s.Store.Export(ctx, fn)
+}
+
+func (s *slowQueryStore) BulkPut(ctx context.Context, items []Item) (int, error) {
+	defer s.observe(ctx, "BulkPut")()
+	return s.Store.BulkPut(ctx, items)
+}
+
+func (s *slowQueryStore) BulkUpsert(ctx context.Context, items []Item) error {
+	defer s.observe(ctx, "BulkUpsert")()
+	return s.Store.BulkUpsert(ctx, items)
+}
+
+func (s *slowQueryStore) DeleteAll(ctx context.Context) (int, error) {
+	defer s.observe(ctx, "DeleteAll")()
+	return s.Store.DeleteAll(ctx)
+}
+
+func (s *slowQueryStore) DeleteExpired(ctx context.Context) (int, error) {
+	defer s.observe(ctx, "DeleteExpired")()
+	return s.Store.DeleteExpired(ctx)
+}
+
+// transientRetryDelay delay before the second attempt of a store call which failed with transient error,
+// it doubles for every next attempt
+var transientRetryDelay = 10 * time.Millisecond
+
+// isTransientError reports whether err is a database error which can go away on its own. Serialization failures
+// and deadlocks roll back the transaction, connection errors happen when DB restarts or fails over.
+// Busy pool isn't transient here, the call has already waited for a connection for DBAcquireTimeout.
+func isTransientError(err error) bool {
+	if errors.Is(err, ErrStoreBusy) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// 40001 serialization_failure, 40P01 deadlock_detected, 08 class is connection exceptions
+		return pgErr.Code == "40001" || pgErr.Code == "40P01" || strings.HasPrefix(pgErr.Code, "08")
+	}
+	return pgconn.SafeToRetry(err) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// retryingStore Store decorator which retries reads and idempotent writes failed with transient errors,
+// up to attempts times. Calls which can't be repeated safely aren't retried: Put, BulkPut and CompareAndUpdate
+// may have been committed before the connection was lost, so repeating them reports a conflict instead of
+// success, and Export can't take back items it has already passed to fn. Ping isn't retried too,
+// so health checks see failures as they are.
+type retryingStore struct {
+	Store
+	attempts int
+}
+
+// retry calls call until it succeeds or fails with not transient error, up to s.attempts times
+func (s *retryingStore) retry(ctx context.Context, call func(context.Context) error) error {
+	var permanentErr error
+	err := retryWithBackoff(ctx, s.attempts, transientRetryDelay, func(ctx context.Context) error {
+		err := call(ctx)
+		if err != nil && !isTransientError(err) {
+			permanentErr = err
+			return nil // stops retrying, the error is returned below
+		}
+		return err
+	})
+	if permanentErr != nil {
+		return permanentErr
+	}
+	return err
+}
+
+func (s *retryingStore) Get(ctx context.Context, itemID string) (item StoredItem, err error) {
+	err = s.retry(ctx, func(ctx context.Context) error {
+		item, err = s.Store.Get(ctx, itemID)
+		return err
+	})
+	return item, err
+}
+
+func (s *retryingStore) GetMany(ctx context.Context, itemIDs []string) (items map[string]Item, err error) {
+	err = s.retry(ctx, func(ctx context.Context) error {
+		items, err = s.Store.GetMany(ctx, itemIDs)
+		return err
+	})
+	return items, err
+}
+
+func (s *retryingStore) Exists(ctx context.Context, itemID string) error {
+	return s.retry(ctx, func(ctx context.Context) error {
+		return s.Store.Exists(ctx, itemID)
+	})
+}
+
+// Upsert is retried, because repeating it leaves the same item. Only the inserted flag can be false
+// when the lost attempt has inserted the item.
+func (s *retryingStore) Upsert(ctx context.Context, item Item) (stored StoredItem, inserted bool, err error) {
+	err = s.retry(ctx, func(ctx context.Context) error {
+		stored, inserted, err = s.Store.Upsert(ctx, item)
+		return err
+	})
+	return stored, inserted, err
+}
+
+func (s *retryingStore) Update(ctx context.Context, itemID string, update ItemUpdate) error {
+	return s.retry(ctx, func(ctx context.Context) error {
+		return s.Store.Update(ctx, itemID, update)
+	})
+}
+
+func (s *retryingStore) List(
+	ctx context.Context,
+	limit int,
+	offset int,
+	after string,
+	prefix string,
+	includeDeleted bool,
+) (items []Item, err error) {
+	err = s.retry(ctx, func(ctx context.Context) error {
+		items, err = s.Store.List(ctx, limit, offset, after, prefix, includeDeleted)
+		return err
+	})
+	return items, err
+}
+
+func (s *retryingStore) Count(ctx context.Context) (count int, err error) {
+	err = s.retry(ctx, func(ctx context.Context) error {
+		count, err = s.Store.Count(ctx)
+		return err
+	})
+	return count, err
+}
+
+func (s *retryingStore) Search(ctx context.Context, query string, limit int) (items []Item, err error) {
+	err = s.retry(ctx, func(ctx context.Context) error {
+		items, err = s.Store.Search(ctx, query, limit)
+		return err
+	})
+	return items, err
+}
+
+func (s *retryingStore) BulkUpsert(ctx context.Context, items []Item) error {
+	return s.retry(ctx, func(ctx context.Context) error {
+		return s.Store.BulkUpsert(ctx, items)
+	})
+}
+
+func (s *retryingStore) DeleteExpired(ctx context.Context) (deleted int, err error) {
+	err = s.retry(ctx, func(ctx context.Context) error {
+		deleted, err = s.Store.DeleteExpired(ctx)
+		return err
+	})
+	return deleted, err
+}
+
+// webhookStore Store decorator which notifies webhook about items created by Put, Upsert, BulkPut and BulkUpsert
+type webhookStore struct {
+	Store
+	notifier *webhookNotifier
+}
+
+func (s *webhookStore) Put(ctx context.Context, item Item) (StoredItem, bool, error) {
+	storedItem, created, err := s.Store.Put(ctx, item)
+	if err == nil && created {
+		s.notifier.notify(storedItem)
+	}
+	return storedItem, created, err
+}
+
+func (s *webhookStore) Upsert(ctx context.Context, item Item) (StoredItem, bool, error) {
+	storedItem, inserted, err := s.Store.Upsert(ctx, item)
+	if err == nil && inserted {
+		s.notifier.notify(storedItem)
+	}
+	return storedItem, inserted, err
+}
+
+func (s *webhookStore) BulkPut(ctx context.Context, items []Item) (int, error) {
+	existing, err := existingItemIDs(ctx, s.Store, itemIDsOf(items))
+	if err != nil {
+		return 0, err
+	}
+	created, err := s.Store.BulkPut(ctx, items)
+	if err == nil {
+		s.notifyCreated(ctx, items, existing)
+	}
+	return created, err
+}
+
+func (s *webhookStore) BulkUpsert(ctx context.Context, items []Item) error {
+	existing, err := existingItemIDs(ctx, s.Store, itemIDsOf(items))
+	if err != nil {
+		return err
+	}
+	err = s.Store.BulkUpsert(ctx, items)
+	if err == nil {
+		s.notifyCreated(ctx, items, existing)
+	}
+	return err
+}
+
+// notifyCreated notifies webhook about items which didn't exist before a bulk write. Bulk writes don't return
+// stored items, so they are read from the primary store to have the same timestamps as Put notifications.
+// Items which can't be read, e.g. they are deleted concurrently, are skipped.
+func (s *webhookStore) notifyCreated(ctx context.Context, items []Item, existing map[string]bool) {
+	for _, item := range items {
+		if existing[item.ItemId] {
+			continue
+		}
+		existing[item.ItemId] = true // the same item can be in the batch more than once
+		storedItem, err := s.Store.Get(withPrimaryRead(ctx), item.ItemId)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to read created item for webhook, notification is dropped",
+				slog.String("item_id", item.ItemId), slog.Any("error", err))
+			continue
+		}
+		s.notifier.notify(storedItem)
+	}
+}
+
+// Types of events published about changed items. Truncated and expired events are about many items, stores
+// don't report which ones, so they have count of removed items instead of item ID: truncated means all items
+// are removed, and expired means items with expired TTL are removed.
+const (
+	EventItemCreated    = "created"
+	EventItemUpdated    = "updated"
+	EventItemDeleted    = "deleted"
+	EventItemsTruncated = "truncated"
+	EventItemsExpired   = "expired"
+)
+
+// ItemEvent event about changed item, value is omitted for deleted items
+type ItemEvent struct {
+	Type   string          `json:"type"`
+	ItemID string          `json:"item_id,omitempty"`
+	Value  json.RawMessage `json:"value,omitempty"`
+	Count  int             `json:"count,omitempty"`
+	Time   time.Time       `json:"time"`
+}
+
+// eventPublisher publishes events asynchronously, delivery errors are logged and don't fail the caller
+type eventPublisher interface {
+	Publish(event ItemEvent)
+	// Close delivers pending events and releases resources
+	Close() error
+}
+
+// kafkaPublisher eventPublisher which publishes events as JSON messages to Kafka topic, keyed by item ID,
+// so events of the same item keep their order
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func newKafkaPublisher(brokers []string, topic string) *kafkaPublisher {
+	return &kafkaPublisher{writer: &kafka.Writer{
+		Addr:     kafka.TCP(brokers...),
+		Topic:    topic,
+		Balancer: &kafka.Hash{},
+		Async:    true,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				slog.Error("Failed to publish events to Kafka", slog.Int("count", len(messages)), slog.Any("error", err))
+			}
+		},
+	}}
+}
+
+func (p *kafkaPublisher) Publish(event ItemEvent) {
+	message, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Failed to encode event", slog.String("item_id", event.ItemID), slog.Any("error", err))
+		return
+	}
+	// Writer is async, so it returns right away, and errors are reported to Completion
+	err = p.writer.WriteMessages(context.Background(), kafka.Message{Key: []byte(event.ItemID), Value: message})
+	if err != nil {
+		slog.Error("Failed to publish event to Kafka", slog.String("item_id", event.ItemID), slog.Any("error", err))
+	}
+}
+
+func (p *kafkaPublisher) Close() error {
+	return p.writer.Close()
+}
+
+// eventStore Store decorator which publishes an event for every changed item. Bulk operations read which of
+// their items exist before the change, so they publish created and updated events, or deleted events for
+// existing items only. DeleteAll and DeleteExpired publish a single event with count of removed items.
+type eventStore struct {
+	Store
+	publisher eventPublisher
+}
+
+func (s *eventStore) Put(ctx context.Context, item Item) (StoredItem, bool, error) {
+	storedItem, created, err := s.Store.Put(ctx, item)
+	if err == nil && created {
+		s.publish(EventItemCreated, item.ItemId, &ItemUpdate{Value: item.Value, ValueIsJSON: item.ValueIsJSON})
+	}
+	return storedItem, created, err
+}
+
+func (s *eventStore) Upsert(ctx context.Context, item Item) (StoredItem, bool, error) {
+	storedItem, inserted, err := s.Store.Upsert(ctx, item)
+	if err == nil {
+		eventType := EventItemUpdated
+		if inserted {
+			eventType = EventItemCreated
+		}
+		s.publish(eventType, item.ItemId, &ItemUpdate{Value: item.Value, ValueIsJSON: item.ValueIsJSON})
+	}
+	return storedItem, inserted, err
+}
+
+func (s *eventStore) Update(ctx context.Context, itemID string, update ItemUpdate) error {
+	err := s.Store.Update(ctx, itemID, update)
+	if err == nil {
+		s.publish(EventItemUpdated, itemID, &update)
+	}
+	return err
+}
+
+func (s *eventStore) CompareAndUpdate(ctx context.Context, itemID string, current ItemUpdate, update ItemUpdate) error {
+	err := s.Store.CompareAndUpdate(ctx, itemID, current, update)
+	if err == nil {
+		s.publish(EventItemUpdated, itemID, &update)
+	}
+	return err
+}
+
+func (s *eventStore) Delete(ctx context.Context, itemID string) error {
+	err := s.Store.Delete(ctx, itemID)
+	if err == nil {
+		s.publish(EventItemDeleted, itemID, nil)
+	}
+	return err
+}
+
+func (s *eventStore) DeleteMany(ctx context.Context, itemIDs []string) (int, error) {
+	existing, err := existingItemIDs(ctx, s.Store, itemIDs)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := s.Store.DeleteMany(ctx, itemIDs)
+	if err == nil {
+		for _, itemID := range itemIDs {
+			if existing[itemID] {
+				delete(existing, itemID) // duplicated IDs are deleted once
+				s.publish(EventItemDeleted, itemID, nil)
+			}
+		}
+	}
+	return deleted, err
+}
+
+func (s *eventStore) BulkPut(ctx context.Context, items []Item) (int, error) {
+	existing, err := existingItemIDs(ctx, s.Store, itemIDsOf(items))
+	if err != nil {
+		return 0, err
+	}
+	created, err := s.Store.BulkPut(ctx, items)
+	if err == nil {
+		for _, item := range items {
+			if !existing[item.ItemId] {
+				existing[item.ItemId] = true // later duplicates in the batch are skipped as existing
+				s.publish(EventItemCreated, item.ItemId, &ItemUpdate{Value: item.Value, ValueIsJSON: item.ValueIsJSON})
+			}
+		}
+	}
+	return created, err
+}
+
+func (s *eventStore) BulkUpsert(ctx context.Context, items []Item) error {
+	existing, err := existingItemIDs(ctx, s.Store, itemIDsOf(items))
+	if err != nil {
+		return err
+	}
+	err = s.Store.BulkUpsert(ctx, items)
+	if err == nil {
+		for _, item := range items {
+			eventType := EventItemUpdated
+			if !existing[item.ItemId] {
+				existing[item.ItemId] = true
+				eventType = EventItemCreated
+			}
+			s.publish(eventType, item.ItemId, &ItemUpdate{Value: item.Value, ValueIsJSON: item.ValueIsJSON})
+		}
+	}
+	return err
+}
+
+func (s *eventStore) DeleteAll(ctx context.Context) (int, error) {
+	deleted, err := s.Store.DeleteAll(ctx)
+	if err == nil {
+		s.publisher.Publish(ItemEvent{Type: EventItemsTruncated, Count: deleted, Time: time.Now().UTC()})
+	}
+	return deleted, err
+}
+
+func (s *eventStore) DeleteExpired(ctx context.Context) (int, error) {
+	deleted, err := s.Store.DeleteExpired(ctx)
+	if err == nil && deleted > 0 {
+		s.publisher.Publish(ItemEvent{Type: EventItemsExpired, Count: deleted, Time: time.Now().UTC()})
+	}
+	return deleted, err
+}
+
+// existingItemIDs returns IDs of items which exist in store before a bulk change, they are read from
+// the primary store, so replica lag doesn't make existing items look new. Items changed concurrently between
+// the read and the change may still be reported wrong.
+func existingItemIDs(ctx context.Context, store Store, itemIDs []string) (map[string]bool, error) {
+	items, err := store.GetMany(withPrimaryRead(ctx), itemIDs)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool, len(items))
+	for itemID := range items {
+		existing[itemID] = true
+	}
+	return existing, nil
+}
+
+// itemIDsOf returns IDs of items in the same order
+func itemIDsOf(items []Item) []string {
+	itemIDs := make([]string, 0, len(items))
+	for _, item := range items {
+		itemIDs = append(itemIDs, item.ItemId)
+	}
+	return itemIDs
+}
+
+// publish publishes event about item, value is nil for deleted items
+func (s *eventStore) publish(eventType string, itemID string, value *ItemUpdate) {
+	event := ItemEvent{Type: eventType, ItemID: itemID, Time: time.Now().UTC()}
+	if value != nil {
+		event.Value = valueJSON(value.Value, value.ValueIsJSON)
+	}
+	s.publisher.Publish(event)
+}
+
+// retryWithBackoff calls operation until it succeeds, up to attempts times, doubling delay between attempts
+// starting from baseDelay. It stops earlier and returns the last error when ctx is done.
+func retryWithBackoff(ctx context.Context, attempts int, baseDelay time.Duration, operation func(context.Context) error) error {
+	delay := baseDelay
+	for attempt := 1; ; attempt++ {
+		err := operation(ctx)
+		if err == nil || attempt >= attempts {
+			return err
+		}
+		slog.Debug("Operation failed, will retry",
+			slog.Int("attempt", attempt),
+			slog.Duration("delay", delay),
+			slog.Any("error", err),
+		)
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// dbConnString returns connection string from cfg.DatabaseURL and its source name for logs and errors.
+// When DatabaseURL isn't set, it returns empty string, so pgx takes connection parameters from PG* env variables.
+func dbConnString(cfg Config) (connString string, source string) {
+	if cfg.DatabaseURL != "" {
+		return cfg.DatabaseURL, "DATABASE_URL"
+	}
+	return "", "PG* env variables"
+}
+
+// setsStatementTimeout checks if the connection string sets statement_timeout, either as a parameter or in
+// options, e.g. options='-c statement_timeout=5000'
+func setsStatementTimeout(config *pgx.ConnConfig) bool {
+	_, ok := config.RuntimeParams["statement_timeout"]
+	return ok || strings.Contains(config.RuntimeParams["options"], "statement_timeout")
+}
+
+// buildPoolConfig parses connString and applies pool settings and statement timeout of cfg to the pool config,
+// keeping pgx defaults for unset pool settings.
+func buildPoolConfig(connString string, cfg Config) (*pgxpool.Config, error) {
+	config, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.PoolMaxConns > 0 {
+		config.MaxConns = int32(cfg.PoolMaxConns)
+	}
+	if cfg.PoolMinConns > 0 {
+		config.MinConns = int32(cfg.PoolMinConns)
+	}
+	if config.MinConns > config.MaxConns {
+		return nil, fmt.Errorf(
+			"POOL_MIN_CONNS(%d) must not be greater than POOL_MAX_CONNS(%d)", config.MinConns, config.MaxConns,
+		)
+	}
+	if cfg.PoolMaxConnLifetime > 0 {
+		config.MaxConnLifetime = cfg.PoolMaxConnLifetime
+	}
+	if cfg.PoolMaxConnIdleTime > 0 {
+		config.MaxConnIdleTime = cfg.PoolMaxConnIdleTime
+	}
+	// statement_timeout aborts runaway queries in DB itself, so they don't pin connections when context
+	// deadline is generous. 0 keeps timeout of the connection string or DB server, and the default one
+	// is applied only when the connection string doesn't set it.
+	statementTimeout := cfg.DBStatementTimeout
+	if statementTimeout > 0 && (cfg.DBStatementTimeoutExplicit || !setsStatementTimeout(config.ConnConfig)) {
+		// Postgres takes milliseconds, shorter timeouts are rounded up, so they don't turn into 0 which disables it
+		milliseconds := (statementTimeout + time.Millisecond - 1) / time.Millisecond
+		config.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(int64(milliseconds), 10)
+	}
+	if cfg.PgBouncerMode {
+		config.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+		config.ConnConfig.StatementCacheCapacity = 0
+		config.ConnConfig.DescriptionCacheCapacity = 0
+	}
+	return config, nil
+}
+
+// connectToDB creates a new database connection pool and cleans up the pool when done.
+// It expects a context and WaitGroup for pool cleanup goroutine, connString and its source name for logs and errors,
+// and cfg with pool and connection retry settings.
+// It returns a channel where bool must be written to clean up the pool.
+func connectToDB(
+	ctx context.Context, wg *sync.WaitGroup, connString string, source string, cfg Config,
+) (*pgxpool.Pool, chan bool, error) {
+	cleanDBPoolChannel := make(chan bool, 1)
+	poolConfig, err := buildPoolConfig(connString, cfg)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) { // url.Error contains the whole URL with password, we don't want to log it
+			err = urlErr.Err
+		}
+		return nil, cleanDBPoolChannel, fmt.Errorf("invalid connection parameters in %s: %w", source, err)
+	}
+	slog.Debug("Connection parameters loaded", slog.String("source", source))
+	// DB may be still starting when the app starts, e.g. in docker compose, so we retry the connection
+	var dbPool *pgxpool.Pool
+	err = retryWithBackoff(ctx, cfg.DBConnectAttempts, cfg.DBConnectRetryDelay, func(ctx context.Context) error {
+		pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+		if err != nil {
+			return err
+		}
+		if err = pool.Ping(ctx); err != nil {
+			pool.Close()
+			return err
+		}
+		dbPool = pool
+		return nil
+	})
+	if err != nil {
+		return nil, cleanDBPoolChannel, err
+	}
+	slog.Info("Connected to the database",
+		slog.String("source", source),
+		slog.String("host", dbPool.Config().ConnConfig.Host),
+		slog.Uint64("port", uint64(dbPool.Config().ConnConfig.Port)),
+		slog.String("database", dbPool.Config().ConnConfig.Database),
+		slog.String("user", dbPool.Config().ConnConfig.User),
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-cleanDBPoolChannel:
+				if dbPool != nil {
+					slog.Info("Closing db-pool...")
+					dbPool.Close()
+					return
+				}
+			case <-time.After(time.Second * 5):
+				slog.Debug("Waiting for db-pool to close...")
+			}
+		}
+	}()
+	return dbPool, cleanDBPoolChannel, nil
+}
+
+// sqliteNotExpired SQL condition which filters out expired items, it expects current unix time in milliseconds
+const sqliteNotExpired = "(expires_at IS NULL OR expires_at > ?)"
+
+// sqliteVisible SQL condition which filters out expired and soft-deleted items, it expects the same parameter
+// as sqliteNotExpired
+const sqliteVisible = "deleted_at IS NULL AND " + sqliteNotExpired
+
+// sqliteInsertItem the same as pgInsertItem, but for SQLite. It expects id, value, value_is_json, created_at,
+// updated_at, expires_at, attributes and current unix time in milliseconds.
+const sqliteInsertItem = `INSERT INTO data (id, value, value_is_json, created_at, updated_at, expires_at, attributes)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (id) DO UPDATE
+	SET value = excluded.value, value_is_json = excluded.value_is_json, attributes = excluded.attributes,
+		created_at = excluded.created_at,
+		updated_at = excluded.updated_at, expires_at = excluded.expires_at, deleted_at = NULL
+	WHERE data.expires_at <= ? OR data.deleted_at IS NOT NULL`
+
+// sqliteUpsertItem the same as pgUpsertItem, but for SQLite, it expects the same parameters as sqliteInsertItem.
+// SQLite doesn't have xmax, but created_at is equal to updated_at only for inserted or replaced
+// expired and soft-deleted items.
+const sqliteUpsertItem = `INSERT INTO data (id, value, value_is_json, created_at, updated_at, expires_at, attributes)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (id) DO UPDATE
+	SET value = excluded.value, value_is_json = excluded.value_is_json, attributes = excluded.attributes,
+		updated_at = excluded.updated_at,
+		expires_at = excluded.expires_at, deleted_at = NULL,
+		created_at = CASE WHEN data.expires_at <= ? OR data.deleted_at IS NOT NULL
+			THEN excluded.created_at ELSE data.created_at END
+	RETURNING created_at, created_at = updated_at`
+
+// unixMilliOrNil converts optional time to unix milliseconds, which we use to keep expires_at in SQLite
+func unixMilliOrNil(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UnixMilli()
+}
+
+// timeFromUnixMilli converts optional unix milliseconds from SQLite to time
+func timeFromUnixMilli(value sql.NullInt64) *time.Time {
+	if !value.Valid {
+		return nil
+	}
+	t := time.UnixMilli(value.Int64).UTC()
+	return &t
+}
+
+// sqliteStore Store implementation which keeps items in SQLite, handy for local experiments and tests
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func (s *sqliteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqliteStore) Get(ctx context.Context, itemID string) (StoredItem, error) {
+	item := StoredItem{Item: Item{ItemId: itemID}}
+	var expiresAt sql.NullInt64
+	err := s.db.QueryRowContext(
+		ctx,
+		"SELECT value, value_is_json, attributes, created_at, updated_at, expires_at FROM data WHERE id = ? AND "+sqliteVisible,
+		itemID, time.Now().UnixMilli(),
+	).Scan(&item.Value, &item.ValueIsJSON, &item.Attributes, &item.CreatedAt, &item.UpdatedAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StoredItem{}, ErrItemNotFound
+	}
+	item.ExpiresAt = timeFromUnixMilli(expiresAt)
+	return item, err
+}
+
+func (s *sqliteStore) GetMany(ctx context.Context, itemIDs []string) (map[string]Item, error) {
+	found := make(map[string]Item, len(itemIDs))
+	if len(itemIDs) == 0 {
+		return found, nil
+	}
+	// SQLite doesn't support arrays, so we pass every ID as a separate parameter
+	args := make([]any, 0, len(itemIDs)+1)
+	for _, itemID := range itemIDs {
+		args = append(args, itemID)
+	}
+	args = append(args, time.Now().UnixMilli())
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(itemIDs)), ", ")
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT id, value, value_is_json FROM data WHERE id IN ("+placeholders+") AND "+sqliteVisible,
+		args...,
+	)
+	items, err := scanSQLiteItems(rows, err)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		found[item.ItemId] = item
+	}
+	return found, nil
+}
+
+func (s *sqliteStore) Exists(ctx context.Context, itemID string) error {
+	var found int
+	err := s.db.QueryRowContext(
+		ctx,
+		"SELECT 1 FROM data WHERE id = ? AND "+sqliteVisible,
+		itemID, time.Now().UnixMilli(),
+	).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrItemNotFound
+	}
+	return err
+}
+
+func (s *sqliteStore) Put(ctx context.Context, item Item) (StoredItem, bool, error) {
+	now := time.Now().UTC()
+	expiresAt := item.expiresAt(now)
+	res, err := s.db.ExecContext(
+		ctx,
+		sqliteInsertItem,
+		item.ItemId, item.Value, item.ValueIsJSON, now, now, unixMilliOrNil(expiresAt), item.Attributes.jsonText(),
+		now.UnixMilli(),
+	)
+	if err != nil {
+		return StoredItem{}, false, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil || rowsAffected == 0 { // item already exists, nothing was inserted
+		return StoredItem{}, false, err
+	}
+	return StoredItem{Item: item, CreatedAt: now, UpdatedAt: now, ExpiresAt: expiresAt}, true, nil
+}
+
+func (s *sqliteStore) Upsert(ctx context.Context, item Item) (StoredItem, bool, error) {
+	now := time.Now().UTC()
+	expiresAt := item.expiresAt(now)
+	storedItem := StoredItem{Item: item, UpdatedAt: now, ExpiresAt: expiresAt}
+	var inserted bool
+	err := s.db.QueryRowContext(
+		ctx,
+		sqliteUpsertItem,
+		item.ItemId, item.Value, item.ValueIsJSON, now, now, unixMilliOrNil(expiresAt), item.Attributes.jsonText(),
+		now.UnixMilli(),
+	).Scan(&storedItem.CreatedAt, &inserted)
+	if err != nil {
+		return StoredItem{}, false, err
+	}
+	return storedItem, inserted, nil
+}
+
+func (s *sqliteStore) Update(ctx context.Context, itemID string, update ItemUpdate) error {
+	now := time.Now().UTC()
+	res, err := s.db.ExecContext(
+		ctx,
+		`UPDATE data SET value = ?, value_is_json = ?, attributes = COALESCE(?, attributes), updated_at = ?
+		WHERE id = ? AND `+sqliteVisible,
+		update.Value, update.ValueIsJSON, nullableAttributes(update.Attributes), now, itemID, now.UnixMilli(),
+	)
+	return sqliteRowsAffectedOrNotFound(res, err)
+}
+
+func (s *sqliteStore) CompareAndUpdate(ctx context.Context, itemID string, current ItemUpdate, update ItemUpdate) error {
+	now := time.Now().UTC()
+	res, err := s.db.ExecContext(
+		ctx,
+		`UPDATE data SET value = ?, value_is_json = ?, attributes = COALESCE(?, attributes), updated_at = ?
+		WHERE id = ? AND value = ? AND value_is_json = ? AND json(attributes) = json(?) AND `+sqliteVisible,
+		update.Value, update.ValueIsJSON, nullableAttributes(update.Attributes), now, itemID, current.Value, current.ValueIsJSON,
+		current.Attributes.jsonText(), now.UnixMilli(),
+	)
+	return sqliteRowsAffectedOrNotFound(res, err)
+}
+
+func (s *sqliteStore) Delete(ctx context.Context, itemID string) error {
+	now := time.Now().UTC()
+	res, err := s.db.ExecContext(
+		ctx,
+		"UPDATE data SET deleted_at = ? WHERE id = ? AND "+sqliteVisible,
+		now, itemID, now.UnixMilli(),
+	)
+	return sqliteRowsAffectedOrNotFound(res, err)
+}
+
+func (s *sqliteStore) DeleteMany(ctx context.Context, itemIDs []string) (int, error) {
+	if len(itemIDs) == 0 {
+		return 0, nil
+	}
+	// SQLite doesn't support arrays, so we pass every ID as a separate parameter
+	now := time.Now().UTC()
+	args := make([]any, 0, len(itemIDs)+2)
+	args = append(args, now)
+	for _, itemID := range itemIDs {
+		args = append(args, itemID)
+	}
+	args = append(args, now.UnixMilli())
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(itemIDs)), ", ")
+	res, err := s.db.ExecContext(
+		ctx,
+		"UPDATE data SET deleted_at = ? WHERE id IN ("+placeholders+") AND "+sqliteVisible,
+		args...,
+	)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	return int(deleted), err
+}
+
+func (s *sqliteStore) List(
+	ctx context.Context,
+	limit int,
+	offset int,
+	after string,
+	prefix string,
+	includeDeleted bool,
+) ([]Item, error) {
+	condition := sqliteVisible
+	if includeDeleted {
+		condition = sqliteNotExpired
+	}
+	// LIKE in SQLite ignores case of ASCII letters, so prefix is matched with instr, which doesn't
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT id, value, value_is_json FROM data WHERE instr(id, ?) = 1 AND id > ? AND "+condition+
+			" ORDER BY id LIMIT ? OFFSET ?",
+		prefix, after, time.Now().UnixMilli(), limit, offset,
+	)
+	return scanSQLiteItems(rows, err)
+}
+
+func (s *sqliteStore) Count(ctx context.Context) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, "SELECT count(*) FROM data WHERE "+sqliteVisible, time.Now().UnixMilli()).Scan(&count)
+	return count, err
+}
+
+func (s *sqliteStore) Search(ctx context.Context, query string, limit int) ([]Item, error) {
+	// LIKE in SQLite ignores case of ASCII letters
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT id, value, value_is_json FROM data WHERE value LIKE '%' || ? || '%' ESCAPE '\' AND `+sqliteVisible+
+			` ORDER BY id LIMIT ?`,
+		escapeLike(query), time.Now().UnixMilli(), limit,
+	)
+	return scanSQLiteItems(rows, err)
+}
+
+func (s *sqliteStore) Export(ctx context.Context, fn func(StoredItem) error) error {
+	rows, err := s.db.QueryContext(
+		ctx,
+		"SELECT id, value, value_is_json, attributes, created_at, updated_at, expires_at FROM data WHERE "+sqliteVisible+
+			" ORDER BY id",
+		time.Now().UnixMilli(),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item StoredItem
+		var expiresAt sql.NullInt64
+		err := rows.Scan(
+			&item.ItemId, &item.Value, &item.ValueIsJSON, &item.Attributes, &item.CreatedAt, &item.UpdatedAt, &expiresAt,
+		)
+		if err != nil {
+			return err
+		}
+		item.ExpiresAt = timeFromUnixMilli(expiresAt)
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStore) BulkPut(ctx context.Context, items []Item) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }() // it does nothing if transaction was committed
+
+	statement, err := tx.PrepareContext(ctx, sqliteInsertItem)
+	if err != nil {
+		return 0, err
+	}
+	defer statement.Close()
+	now := time.Now().UTC()
+	created := 0
+	for _, item := range items {
+		res, err := statement.ExecContext(
+			ctx,
+			item.ItemId, item.Value, item.ValueIsJSON, now, now, unixMilliOrNil(item.expiresAt(now)),
+			item.Attributes.jsonText(), now.UnixMilli(),
+		)
+		if err != nil {
+			return 0, err
+		}
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		created += int(rowsAffected)
+	}
+	return created, tx.Commit()
+}
+
+func (s *sqliteStore) BulkUpsert(ctx context.Context, items []Item) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }() // it does nothing if transaction was committed
+
+	statement, err := tx.PrepareContext(ctx, sqliteUpsertItem)
+	if err != nil {
+		return err
+	}
+	defer statement.Close()
+	now := time.Now().UTC()
+	for _, item := range items {
+		_, err := statement.ExecContext(
+			ctx,
+			item.ItemId, item.Value, item.ValueIsJSON, now, now, unixMilliOrNil(item.expiresAt(now)),
+			item.Attributes.jsonText(), now.UnixMilli(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) DeleteExpired(ctx context.Context) (int, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM data WHERE expires_at < ?", time.Now().UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	return int(deleted), err
+}
+
+func (s *sqliteStore) DeleteAll(ctx context.Context) (int, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM data")
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	return int(deleted), err
+}
+
+// PendingMigrations is always 0, SQLite schema is created as a whole when the store is opened
+func (s *sqliteStore) PendingMigrations(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (s *sqliteStore) PoolStats() PoolStats {
+	stats := s.db.Stats()
+	return PoolStats{
+		AcquiredConns: stats.InUse,
+		IdleConns:     stats.Idle,
+		TotalConns:    stats.OpenConnections,
+		MaxConns:      stats.MaxOpenConnections,
+	}
+}
+
+// scanSQLiteItems reads items from rows with id, value and value_is_json columns, and closes rows.
+// It accepts error of the query, so it can wrap QueryContext call directly.
+func scanSQLiteItems(rows *sql.Rows, err error) ([]Item, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []Item{}
+	for rows.Next() {
+		var item Item
+		if err := rows.Scan(&item.ItemId, &item.Value, &item.ValueIsJSON); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// sqliteRowsAffectedOrNotFound returns ErrItemNotFound if statement didn't change any rows
+func sqliteRowsAffectedOrNotFound(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrItemNotFound
+	}
+	return nil
+}
+
+// initSQLiteStructure the same as initDBStructure, but for SQLite database
+func initSQLiteStructure(ctx context.Context, db *sql.DB) error {
+	// expires_at is kept as unix time in milliseconds, so it can be compared as a number
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS data (
+		id TEXT PRIMARY KEY,
+		value TEXT,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		expires_at INTEGER NULL,
+		value_is_json BOOLEAN NOT NULL DEFAULT FALSE,
+		deleted_at DATETIME NULL,
+		attributes TEXT NOT NULL DEFAULT '{}'
+	);`)
+	if err != nil {
+		return err
+	}
+	// SQLite doesn't support ADD COLUMN IF NOT EXISTS, so we check the columns of tables created by older versions
+	for _, column := range []struct{ name, definition string }{
+		{"expires_at", "INTEGER NULL"},
+		{"value_is_json", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"deleted_at", "DATETIME NULL"},
+		{"attributes", "TEXT NOT NULL DEFAULT '{}'"},
+	} {
+		var hasColumn bool
+		err = db.QueryRowContext(
+			ctx,
+			"SELECT COUNT(*) > 0 FROM pragma_table_info('data') WHERE name = ?",
+			column.name,
+		).Scan(&hasColumn)
+		if err != nil {
+			return err
+		}
+		if !hasColumn {
+			if _, err = db.ExecContext(ctx, "ALTER TABLE data ADD COLUMN "+column.name+" "+column.definition); err != nil {
+				return err
+			}
+		}
+	}
+	slog.Info("Database structure initialized")
+	return nil
+}
+
+// connectToSQLite opens SQLite database file at path(":memory:" for in-memory DB) and closes it when done.
+// It works the same way as connectToDB, and returns a channel where bool must be written to close the DB.
+func connectToSQLite(ctx context.Context, wg *sync.WaitGroup, path string) (*sql.DB, chan bool, error) {
+	cleanDBChannel := make(chan bool, 1)
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, cleanDBChannel, err
+	}
+	// SQLite allows only one writer at a time, and every connection to ":memory:" gets its own database.
+	// So, we use a single connection.
+	db.SetMaxOpenConns(1)
+	err = db.PingContext(ctx)
+	if err != nil {
+		_ = db.Close()
+		return nil, cleanDBChannel, err
+	}
+	slog.Info("Connected to the database", slog.String("driver", "sqlite"), slog.String("path", path))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-cleanDBChannel
+		slog.Info("Closing db...")
+		if err := db.Close(); err != nil {
+			slog.Error("Failed to close db", slog.Any("error", err))
+		}
+	}()
+	return db, cleanDBChannel, nil
+}
+
+// openStore connects to the database selected by cfg.DBDriver and initializes its structure.
+// It returns a channel where bool must be written to close DB connections, the channel is valid even on error.
+func openStore(ctx context.Context, wg *sync.WaitGroup, cfg Config) (Store, chan bool, error) {
+	if cfg.DBDriver == "sqlite" {
+		db, cleanDBChannel, err := connectToSQLite(ctx, wg, cfg.SQLitePath)
+		if err != nil {
+			return nil, cleanDBChannel, fmt.Errorf("failed to connect to the database: %w", err)
+		}
+		if err = initSQLiteStructure(ctx, db); err != nil {
+			return nil, cleanDBChannel, fmt.Errorf("failed to init DB structure: %w", err)
+		}
+		return &sqliteStore{db: db}, cleanDBChannel, nil
+	}
+	connString, source := dbConnString(cfg)
+	dbPool, cleanDBPoolChannel, err := connectToDB(ctx, wg, connString, source, cfg)
+	if err != nil {
+		return nil, cleanDBPoolChannel, fmt.Errorf("failed to connect to the database: %w", err)
+	}
+	if err = initDBStructure(ctx, dbPool); err != nil {
+		return nil, cleanDBPoolChannel, fmt.Errorf("failed to init DB structure: %w", err)
+	}
+	if cfg.DatabaseReplicaURL == "" {
+		store := newPgStore(dbPool, cfg.DBAcquireTimeout)
+		return store, closePgStoresOnSignal(wg, cleanDBPoolChannel, store), nil
+	}
+	replicaPool, cleanReplicaPoolChannel, err := connectToDB(
+		ctx, wg, cfg.DatabaseReplicaURL, "DATABASE_REPLICA_URL", cfg,
+	)
+	// both pools are closed by a single signal
+	cleanBothPoolsChannel := make(chan bool, 1)
+	go func() {
+		clean := <-cleanBothPoolsChannel
+		cleanDBPoolChannel <- clean
+		cleanReplicaPoolChannel <- clean
+	}()
+	if err != nil {
+		return nil, cleanBothPoolsChannel, fmt.Errorf("failed to connect to the replica database: %w", err)
+	}
+	primary, replica := newPgStore(dbPool, cfg.DBAcquireTimeout), newPgStore(replicaPool, cfg.DBAcquireTimeout)
+
+	cleanStoresChannel := closePgStoresOnSignal(wg, cleanBothPoolsChannel, primary, replica)
+	return &splitStore{Store: primary, replica: replica}, cleanStoresChannel, nil
+}
+
+// closePgStoresOnSignal returns a channel which closes stores on signal and then forwards it to cleanChannel.
+// Pools of stores can be replaced by RestartPool, so pools opened by connectToDB aren't the only ones to close.
+func closePgStoresOnSignal(wg *sync.WaitGroup, cleanChannel chan bool, stores ...*pgStore) chan bool {
+	signalChannel := make(chan bool, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		clean := <-signalChannel
+		for _, store := range stores {
+			store.Close()
+		}
+		cleanChannel <- clean
+	}()
+	return signalChannel
+}
+
+// parseIntQuery reads an optional non-negative integer query parameter, bigger than maxValue values are clamped
+// to it. It returns defaultValue when the parameter isn't provided.
+func parseIntQuery(c *gin.Context, name string, defaultValue int, maxValue int) (int, error) {
+	raw, ok := c.GetQuery(name)
+	if !ok {
+		return min(defaultValue, maxValue), nil
+	}
+	value, err := strconv.Atoi(raw)
+	if errors.Is(err, strconv.ErrRange) && !strings.HasPrefix(raw, "-") { // too big number is still a valid one
+		return maxValue, nil
+	}
+	if err != nil || value < 0 {
+		return 0, FieldError{Field: name, Reason: "must be a non-negative integer"}
+	}
+	return min(value, maxValue), nil
+}
+
+// encodeCursor returns cursor of the page which starts after item with itemID. It's opaque for clients,
+// base64 keeps any ID safe in URLs and headers.
+func encodeCursor(itemID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(itemID))
+}
+
+// parseCursorQuery reads an optional cursor query parameter and returns ID of the item which the page starts after.
+// It returns empty string when the parameter isn't provided, so the page starts from the first item.
+func parseCursorQuery(c *gin.Context) (string, error) {
+	raw := c.Query("cursor")
+	if raw == "" {
+		return "", nil
+	}
+	itemID, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil || validateItemID(string(itemID)) != nil {
+		return "", FieldError{Field: "cursor", Reason: "must be a cursor returned by the previous page"}
+	}
+	return string(itemID), nil
+}
+
+// parseTextQuery reads an optional text query parameter, which must be valid text not longer than maxLength
+// characters. It returns empty string when the parameter isn't provided.
+func parseTextQuery(c *gin.Context, name string, maxLength int) (string, error) {
+	value := c.Query(name)
+	if err := validateText(name, value); err != nil {
+		return "", err
+	}
+	if utf8.RuneCountInString(value) > maxLength {
+		return "", FieldError{Field: name, Reason: fmt.Sprintf("must not be longer than %d characters", maxLength)}
+	}
+	return value, nil
+}
+
+// itemETag returns strong ETag of item value encoded as JSON and its attributes, so a change of either one
+// invalidates cached copies and fails If-Match
+func itemETag(value string, attributes Attributes) string {
+	hash := sha256.Sum256([]byte(value + "\n" + attributes.jsonText()))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// xmlETag returns ETag of XML representation of item which JSON representation has etag. Representations have
+// different bytes, so they must not share a strong ETag.
+func xmlETag(etag string) string {
+	return strings.TrimSuffix(etag, `"`) + `-xml"`
+}
+
+// etagMatches checks if If-None-Match header value matches etag. Header can contain a list of ETags or "*".
+// Weak comparison is used as RFC 9110 requires for If-None-Match.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatchesStrong checks if If-Match header value matches etag. Header can contain a list of ETags or "*".
+// Strong comparison is used as RFC 9110 requires for If-Match, so weak ETags never match.
+func etagMatchesStrong(ifMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// bindJSONBody binds JSON request body to obj, reading not more than MaxBodyBytes of the config from the body.
+// If binding fails, it responds with 415 for content type not in AllowedContentTypes,
+// 413 for too big body or 400 for malformed JSON or invalid fields and returns false.
+func bindJSONBody(c *gin.Context, obj any) bool {
+	cfg := requestConfig(c)
+	if contentType := strings.ToLower(c.ContentType()); !slices.Contains(cfg.AllowedContentTypes, contentType) {
+		respondJSON(
+			c,
+			http.StatusUnsupportedMediaType,
+			errorResponse(ErrorCodeUnsupportedMediaType, fmt.Sprintf(
+				"unsupported content type %q, expected one of %s", contentType, strings.Join(cfg.AllowedContentTypes, ", "),
+			)),
+		)
+		return false
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, cfg.MaxBodyBytes)
+	if err := c.ShouldBindBodyWithJSON(obj); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		var validationErrors validator.ValidationErrors
+		var sliceValidationErrors binding.SliceValidationError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			respondJSON(c, http.StatusRequestEntityTooLarge, errorResponse(ErrorCodePayloadTooLarge, err.Error()))
+		case errors.As(err, &validationErrors) || errors.As(err, &sliceValidationErrors):
+			respondValidationError(c, bindingErrors(obj))
+		default:
+			respondJSON(c, http.StatusBadRequest, errorResponse(ErrorCodeInvalidRequest, err.Error()))
+		}
+		return false
+	}
+	return true
+}
+
+// corsMiddleware sets Access-Control-Allow-* headers for requests from allowedOrigins
+// and responds to preflight OPTIONS requests, so browser clients can call API cross-origin.
+func corsMiddleware(allowedOrigins []string) gin.HandlerFunc {
+	allowAnyOrigin := slices.Contains(allowedOrigins, "*")
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" || (!allowAnyOrigin && !slices.Contains(allowedOrigins, origin)) {
+			c.Next()
+			return
+		}
+		if allowAnyOrigin {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Writer.Header().Add("Vary", "Origin")
+		}
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+			// requested headers are allowed as is, so If-Match of PATCH and Idempotency-Key of POST pass too
+			if requestHeaders := c.GetHeader("Access-Control-Request-Headers"); requestHeaders != "" {
+				c.Header("Access-Control-Allow-Headers", requestHeaders)
+			}
+			c.Header("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
+
+// gzipResponseWriter buffers response body until it reaches minSize, then compresses the body with gzip.
+// Smaller bodies are written as is, because compression doesn't save much for them.
+type gzipResponseWriter struct {
+	gin.ResponseWriter
+	minSize     int
+	buffer      []byte
+	gzip        *gzip.Writer
+	passthrough bool // body is written without compression
+}
+
+// Unwrap returns the wrapped writer, so http.ResponseController reaches the connection through it
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	switch {
+	case w.gzip != nil:
+		return w.gzip.Write(data)
+	case w.passthrough:
+		return w.ResponseWriter.Write(data)
+	}
+	w.buffer = append(w.buffer, data...)
+	if len(w.buffer) < w.minSize {
+		return len(data), nil
+	}
+	if w.Header().Get("Content-Encoding") != "" { // body is already encoded by the handler
+		w.passthrough = true
+		return len(data), w.writeBuffer()
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.gzip = gzip.NewWriter(w.ResponseWriter)
+	if _, err := w.gzip.Write(w.buffer); err != nil {
+		return 0, err
+	}
+	w.buffer = nil
+	return len(data), nil
+}
+
+// Written reports buffered body as written, so handlers don't try to write another response after it
+func (w *gzipResponseWriter) Written() bool {
+	return len(w.buffer) > 0 || w.ResponseWriter.Written()
+}
+
+func (w *gzipResponseWriter) WriteString(data string) (int, error) {
+	return w.Write([]byte(data))
+}
+
+// Flush sends buffered data to the client, body which is still smaller than minSize is sent without compression
+func (w *gzipResponseWriter) Flush() {
+	if w.gzip != nil {
+		_ = w.gzip.Flush()
+	} else if !w.passthrough {
+		w.passthrough = true
+		_ = w.writeBuffer()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// writeBuffer writes buffered body without compression
+func (w *gzipResponseWriter) writeBuffer() error {
+	if len(w.buffer) == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(w.buffer)
+	w.buffer = nil
+	return err
+}
+
+// close writes the rest of the body, it has to be called after handler is done
+func (w *gzipResponseWriter) close() error {
+	if w.gzip != nil {
+		return w.gzip.Close()
+	}
+	return w.writeBuffer()
+}
+
+// acceptsGzip checks that Accept-Encoding header allows gzip, e.g. "gzip, deflate" or "*", but not "gzip;q=0"
+func acceptsGzip(acceptEncoding string) bool {
+	for _, encoding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(encoding, ";")
+		name = strings.TrimSpace(name)
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		if quality, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if value, err := strconv.ParseFloat(quality, 64); err == nil && value == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipMiddleware compresses response bodies not smaller than minSize for clients which accept gzip
+func gzipMiddleware(minSize int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		if c.Request.Method == http.MethodHead || !acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Next()
+			return
+		}
+		writer := &gzipResponseWriter{ResponseWriter: c.Writer, minSize: minSize}
+		c.Writer = writer
+		defer func() {
+			c.Writer = writer.ResponseWriter
+			if err := writer.close(); err != nil {
+				slog.DebugContext(c.Request.Context(), "Failed to write compressed response", slog.Any("error", err))
+			}
+		}()
+		c.Next()
+	}
+}
+
+// cacheControlResponseWriter adds Cache-Control header to responses which can be cached
+type cacheControlResponseWriter struct {
+	gin.ResponseWriter
+	value string
+}
+
+// Unwrap returns the wrapped writer, so http.ResponseController reaches the connection through it
+func (w *cacheControlResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// WriteHeader adds Cache-Control header for 200 and 304 codes, errors aren't cached,
+// so clients don't keep getting them after the problem is gone
+func (w *cacheControlResponseWriter) WriteHeader(code int) {
+	if code == http.StatusOK || code == http.StatusNotModified {
+		w.Header().Set("Cache-Control", w.value)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// cacheControlMiddleware allows to cache successful GET responses for maxAgeSeconds. Cached items are
+// revalidated with ETag after max-age passes. Requests with API key can get admin-only data,
+// so their responses aren't cached.
+func cacheControlMiddleware(maxAgeSeconds int) gin.HandlerFunc {
+	value := fmt.Sprintf("public, max-age=%d", maxAgeSeconds)
+	return func(c *gin.Context) {
+		if (c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead) || c.GetHeader("X-API-Key") != "" {
+			c.Next()
+			return
+		}
+		writer := &cacheControlResponseWriter{ResponseWriter: c.Writer, value: value}
+		c.Writer = writer
+		defer func() {
+			c.Writer = writer.ResponseWriter
+		}()
+		c.Next()
+	}
+}
+
+// requireAPIKey rejects requests without X-API-Key header matching apiKey with 401 code.
+// If apiKey is empty, it lets all requests through.
+func requireAPIKey(apiKey string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasValidAPIKey(c, apiKey) {
+			abortWithJSON(
+				c,
+				http.StatusUnauthorized,
+				errorResponse(ErrorCodeUnauthorized, "missing or invalid API key"),
+			)
+			return
+		}
+		c.Next()
+	}
+}
+
+// hasValidAPIKey checks X-API-Key header of the request, any request is valid when apiKey is empty
+func hasValidAPIKey(c *gin.Context, apiKey string) bool {
+	return apiKey == "" || subtle.ConstantTimeCompare([]byte(c.GetHeader("X-API-Key")), []byte(apiKey)) == 1
+}
+
+// storeUnhealthy is set by health monitor when DB doesn't respond to ping, /readyz reports 503 while it's set
+var storeUnhealthy atomic.Bool
+
+// draining is set at the start of graceful shutdown, after that new requests are rejected with 503 code
+var draining atomic.Bool
+
+// drainingMiddleware rejects requests with 503 code while app is shutting down, so load balancers stop sending them.
+// Requests which were started before draining are finished as usual.
+func drainingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if draining.Load() {
+			c.Header("Connection", "close")
+			abortWithJSON(
+				c,
+				http.StatusServiceUnavailable,
+				errorResponse(ErrorCodeUnavailable, "server is shutting down"),
+			)
+			return
+		}
+		c.Next()
+	}
+}
+
+// requestTimeoutMiddleware cancels context of requests which take longer than timeout, so their DB queries
+// are canceled too. Requests without response at that moment get 504 code. Zero timeout disables it.
+func requestTimeoutMiddleware(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if timeout == 0 {
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && !c.Writer.Written() {
+			respondTimeout(c)
+		}
+	}
+}
+
+// liftServerDeadlines removes read and write deadlines of ServerReadTimeout and ServerWriteTimeout from the
+// connection of a streaming request, so long imports and exports aren't cut off. Writers which don't support
+// deadlines, like test recorders, have none to remove, so the error is ignored.
+func liftServerDeadlines(c *gin.Context) {
+	controller := http.NewResponseController(c.Writer)
+	_ = controller.SetReadDeadline(time.Time{})
+	_ = controller.SetWriteDeadline(time.Time{})
+}
+
+// respondTimeout responds with 504 code to request which exceeded RequestTimeout
+func respondTimeout(c *gin.Context) {
+	respondJSON(c, http.StatusGatewayTimeout, errorResponse(ErrorCodeTimeout, "request took too long"))
+}
+
+// limitHeader response header with the limit list and search endpoints applied after clamping, so clients
+// can tell that they got fewer items because of the server maximum, not because there are no more items
+const limitHeader = "X-Effective-Limit"
+
+// nextCursorHeader response header with cursor of the next page of list endpoint, it's missing on the last page
+const nextCursorHeader = "X-Next-Cursor"
+
+// ItemPage response of list endpoint with envelope=true. The default response is a bare array of items for
+// compatibility with existing clients, so they get the cursor only from nextCursorHeader.
+type ItemPage struct {
+	Items []Item `json:"items"`
+	// NextCursor cursor of the next page, it's missing on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// requestIDHeader header used to pass request id between clients, proxies and the app
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength incoming request ids longer than this are replaced with generated ones to keep logs sane
+const maxRequestIDLength = 128
+
+// requestIDKey context key of the request id
+type requestIDKey struct{}
+
+// requestIDFromContext returns request id stored by requestIDMiddleware, or empty string if there is none
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// requestIDMiddleware takes request id from X-Request-ID header or generates a new one,
+// stores it in the request context and echoes it back in the response header.
+// Logs written with the request context (slog.*Context functions) carry the id as request_id attribute.
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(requestIDHeader)
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			requestID = uuid.NewString()
+		}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDKey{}, requestID))
+		c.Header(requestIDHeader, requestID)
+		c.Next()
+	}
+}
+
+// accessLogLevel returns log level of access log line for response status:
+// info for successful responses, warn for client errors and error for server errors
+func accessLogLevel(status int) slog.Level {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return slog.LevelError
+	case status >= http.StatusBadRequest:
+		return slog.LevelWarn
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// accessLogMiddleware logs every completed request through slog with level depending on response status
+func accessLogMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		status := c.Writer.Status()
+		slog.LogAttrs(c.Request.Context(), accessLogLevel(status), "Request completed",
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.String("client_ip", c.ClientIP()),
+			slog.Duration("latency", time.Since(start)),
+		)
+	}
+}
+
+// recoveryMiddleware recovers from panics in handlers, logs panic value and stack trace through slog
+// and responds with 500 code, without passing any internal details to the client.
+func recoveryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler { // used by net/http to abort response, it must be propagated
+				panic(recovered)
+			}
+			slog.ErrorContext(c.Request.Context(), "Panic while handling request",
+				slog.Any("panic", recovered),
+				slog.String("stack", string(debug.Stack())),
+			)
+			abortWithJSON(c, http.StatusInternalServerError, errorResponse(ErrorCodeInternal, "internal server error"))
+		}()
+		c.Next()
+	}
+}
+
+// tracingMiddleware starts a server span for every request, continuing the trace from incoming headers.
+// Span is stored in the request context, so spans created by handlers become its children.
+func tracingMiddleware(tracer trace.Tracer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		if route == "" {
+			route = "unknown route"
+		}
+		ctx, span := tracer.Start(
+			ctx,
+			c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(c.FullPath()),
+			),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// rateLimiter token bucket rate limiter with a separate bucket for every client IP
+type rateLimiter struct {
+	rps         rate.Limit
+	burst       int
+	mu          sync.Mutex
+	limiters    map[string]*clientLimiter
+	lastCleanup time.Time
+}
+
+// clientLimiter token bucket of a single client
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiterIdleTimeout buckets of clients which didn't send requests for this time are removed to save memory
+const rateLimiterIdleTimeout = 3 * time.Minute
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rps:         rate.Limit(rps),
+		burst:       burst,
+		limiters:    map[string]*clientLimiter{},
+		lastCleanup: time.Now(),
+	}
+}
+
+// limiterFor returns token bucket of the client, creating it if needed
+func (l *rateLimiter) limiterFor(clientIP string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastCleanup) > rateLimiterIdleTimeout {
+		for ip, client := range l.limiters {
+			if now.Sub(client.lastSeen) > rateLimiterIdleTimeout {
+				delete(l.limiters, ip)
+			}
+		}
+		l.lastCleanup = now
+	}
+	client, ok := l.limiters[clientIP]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(l.rps, l.burst)}
+		l.limiters[clientIP] = client
+	}
+	client.lastSeen = now
+	return client.limiter
+}
+
+// middleware rejects requests of clients which exceeded their rate limit with 429 code and Retry-After header
+func (l *rateLimiter) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		reservation := l.limiterFor(c.ClientIP()).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel() // we don't wait, so return the token back
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			abortWithJSON(c, http.StatusTooManyRequests, errorResponse(ErrorCodeRateLimited, "rate limit exceeded"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// idempotencyCache keeps responses of requests with Idempotency-Key header in memory,
+// so retried requests get the original response instead of being executed again
+type idempotencyCache struct {
+	window      time.Duration
+	mu          sync.Mutex
+	responses   map[string]*idempotentResponse
+	lastCleanup time.Time
+}
+
+// idempotentResponse response of a request with Idempotency-Key, it isn't done while request is in progress.
+// bodyHash is SHA-256 of the request body, a retry with another body reuses the key by mistake.
+type idempotentResponse struct {
+	done      bool
+	bodyHash  [sha256.Size]byte
+	status    int
+	header    http.Header
+	body      []byte
+	expiresAt time.Time
+}
+
+// idempotencyReplayedHeaders response headers which are replayed, the others, like X-Request-ID, belong to a request
+var idempotencyReplayedHeaders = []string{"Content-Type", "Location"}
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		window:      window,
+		responses:   map[string]*idempotentResponse{},
+		lastCleanup: time.Now(),
+	}
+}
+
+// start returns response of the request with the key, or reserves the key for a new request with bodyHash
+// if it's seen for the first time, in that case it returns nil
+func (ic *idempotencyCache) start(key string, bodyHash [sha256.Size]byte) *idempotentResponse {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	now := time.Now()
+	if now.Sub(ic.lastCleanup) > ic.window {
+		for k, response := range ic.responses {
+			if response.done && now.After(response.expiresAt) {
+				delete(ic.responses, k)
+			}
+		}
+		ic.lastCleanup = now
+	}
+	if response, ok := ic.responses[key]; ok && (!response.done || now.Before(response.expiresAt)) {
+		return response
+	}
+	ic.responses[key] = &idempotentResponse{bodyHash: bodyHash}
+	return nil
+}
+
+// finish saves response of the request with the key, or releases the key if response shouldn't be replayed
+func (ic *idempotencyCache) finish(key string, response *idempotentResponse) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if response == nil {
+		delete(ic.responses, key)
+		return
+	}
+	response.done = true
+	response.expiresAt = time.Now().Add(ic.window)
+	ic.responses[key] = response
+}
+
+// responseRecorder gin.ResponseWriter which keeps a copy of the response body
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+// Unwrap returns the wrapped writer, so http.ResponseController reaches the connection through it
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// middleware replays the original response for requests with already seen Idempotency-Key header.
+// Keys are separate for every route and client IP, so clients don't get responses of each other, API key
+// doesn't tell them apart, because all clients share it. A request with seen key and another body gets 422,
+// instead of silently losing its body. Server errors aren't saved, so such requests can be retried.
+func (ic *idempotencyCache) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idempotencyKey := c.GetHeader("Idempotency-Key")
+		// Dry runs don't change data, so their responses mustn't be replayed for the real request with the same key.
+		// Invalid dry run flag is rejected by handler, so such requests aren't saved too.
+		if dryRun, err := parseDryRun(c); idempotencyKey == "" || dryRun || err != nil {
+			c.Next()
+			return
+		}
+		// body is read here to compare it with the body of the original request, handler reads it from memory
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, requestConfig(c).MaxBodyBytes))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				abortWithJSON(c, http.StatusRequestEntityTooLarge, errorResponse(ErrorCodePayloadTooLarge, err.Error()))
+			} else {
+				abortWithJSON(c, http.StatusBadRequest, errorResponse(ErrorCodeInvalidRequest, err.Error()))
+			}
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		bodyHash := sha256.Sum256(body)
+		key := c.Request.Method + " " + c.FullPath() + " " + c.ClientIP() + " " + idempotencyKey
+		if response := ic.start(key, bodyHash); response != nil {
+			if response.bodyHash != bodyHash {
+				abortWithJSON(
+					c,
+					http.StatusUnprocessableEntity,
+					errorResponse(ErrorCodeInvalidRequest, "Idempotency-Key was already used for a request with another body"),
+				)
+				return
+			}
+			if !response.done {
+				abortWithJSON(
+					c,
+					http.StatusConflict,
+					errorResponse(ErrorCodeConflict, "request with this Idempotency-Key is in progress"),
+				)
+				return
+			}
+			for name, values := range response.header {
+				c.Writer.Header()[name] = values
+			}
+			c.Header("Idempotent-Replayed", "true")
+			c.Writer.WriteHeader(response.status)
+			_, _ = c.Writer.Write(response.body)
+			c.Abort()
+			return
+		}
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		defer func() {
+			c.Writer = recorder.ResponseWriter
+			if r := recover(); r != nil { // release the key, and let recovery middleware handle the panic
+				ic.finish(key, nil)
+				panic(r)
+			}
+			if c.Writer.Status() >= http.StatusInternalServerError {
+				ic.finish(key, nil)
+				return
+			}
+			header := http.Header{}
+			for _, name := range idempotencyReplayedHeaders {
+				if value := c.Writer.Header().Values(name); len(value) > 0 {
+					header[name] = value
+				}
+			}
+			ic.finish(key, &idempotentResponse{
+				bodyHash: bodyHash, status: c.Writer.Status(), header: header, body: recorder.body.Bytes(),
+			})
+		}()
+		c.Next()
+	}
+}
+
+// parseDryRun reads dry run flag from dry_run query parameter or X-Dry-Run header, query parameter takes precedence
+func parseDryRun(c *gin.Context) (bool, error) {
+	raw := c.Query("dry_run")
+	if raw == "" {
+		raw = c.GetHeader("X-Dry-Run")
+	}
+	if raw == "" {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, FieldError{Field: "dry_run", Reason: "must be a boolean"}
+	}
+	return dryRun, nil
+}
+
+// respondDryRunCreate responds with the status POST / would return for item, without inserting it.
+// Nothing is stored, so 201 response has the item from request instead of the stored one, and it has no Location.
+func respondDryRunCreate(c *gin.Context, store Store, item Item) {
+	err := store.Exists(c.Request.Context(), item.ItemId)
+	switch {
+	case errors.Is(err, ErrItemNotFound):
+		respondJSON(c, http.StatusCreated, item)
+	case err != nil:
+		respondInternalError(c, "Failed to check item", err)
+	case requestConfig(c).ConflictStatus == http.StatusConflict:
+		respondJSON(c, http.StatusConflict, errorResponse(ErrorCodeConflict, "item with this item_id already exists"))
+	default:
+		c.Status(http.StatusOK)
+	}
+}
+
+// concurrencyLimiter limits number of in-flight requests of every client IP
+type concurrencyLimiter struct {
+	limit    int
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+func newConcurrencyLimiter(limit int) *concurrencyLimiter {
+	return &concurrencyLimiter{limit: limit, inFlight: map[string]int{}}
+}
+
+// acquire takes a slot of the client, it returns false when all slots are taken
+func (l *concurrencyLimiter) acquire(clientIP string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight[clientIP] >= l.limit {
+		return false
+	}
+	l.inFlight[clientIP]++
+	return true
+}
+
+// release returns a slot of the client, clients without requests are removed to save memory
+func (l *concurrencyLimiter) release(clientIP string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight[clientIP]--
+	if l.inFlight[clientIP] <= 0 {
+		delete(l.inFlight, clientIP)
+	}
+}
+
+// middleware rejects requests of clients which already have limit of requests in flight with 429 code
+func (l *concurrencyLimiter) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clientIP := c.ClientIP()
+		if !l.acquire(clientIP) {
+			c.Header("Retry-After", "1")
+			abortWithJSON(c, http.StatusTooManyRequests, errorResponse(ErrorCodeRateLimited, "too many concurrent requests"))
+			return
+		}
+		defer l.release(clientIP)
+		c.Next()
+	}
+}
+
+// registerPprofRoutes registers net/http/pprof handlers, they are static routes, so /:item_id doesn't shadow them
+func registerPprofRoutes(routes *gin.RouterGroup) {
+	routes.GET("/", gin.WrapF(pprof.Index))
+	routes.GET("/cmdline", gin.WrapF(pprof.Cmdline))
+	routes.GET("/profile", gin.WrapF(pprof.Profile))
+	routes.GET("/symbol", gin.WrapF(pprof.Symbol))
+	routes.POST("/symbol", gin.WrapF(pprof.Symbol))
+	routes.GET("/trace", gin.WrapF(pprof.Trace))
+	// other profiles, like heap or goroutine, are served by Index handler by name from the path
+	routes.GET("/:profile", gin.WrapF(pprof.Index))
+}
+
+// Codes of API errors, clients can rely on them, unlike on error messages
+const (
+	ErrorCodeInvalidRequest       = "invalid_request"
+	ErrorCodeNotFound             = "not_found"
+	ErrorCodeMethodNotAllowed     = "method_not_allowed"
+	ErrorCodeConflict             = "conflict"
+	ErrorCodeUnauthorized         = "unauthorized"
+	ErrorCodeForbidden            = "forbidden"
+	ErrorCodePreconditionFailed   = "precondition_failed"
+	ErrorCodePreconditionRequired = "precondition_required"
+	ErrorCodePayloadTooLarge      = "payload_too_large"
+	ErrorCodeUnsupportedMediaType = "unsupported_media_type"
+	ErrorCodeRateLimited          = "rate_limited"
+	ErrorCodeUnavailable          = "unavailable"
+	ErrorCodeTimeout              = "timeout"
+	ErrorCodeInternal             = "internal"
+)
+
+// errorResponse body of all error responses: {"error": {"code": "...", "message": "..."}}
+func errorResponse(code string, message string) gin.H {
+	return gin.H{"error": gin.H{"code": code, "message": message}}
+}
+
+// respondNotFound responds with 404 code and not_found error
+func respondNotFound(c *gin.Context) {
+	respondJSON(c, http.StatusNotFound, errorResponse(ErrorCodeNotFound, "item not found"))
+}
+
+// configContextKey key of Gin context where createRouter keeps its config for request helpers
+const configContextKey = "go_app.config"
+
+// requestConfig returns config of the router which handles the request,
+// or DefaultConfig when the request didn't go through createRouter, e.g. in tests of a single middleware
+func requestConfig(c *gin.Context) *Config {
+	if cfg, ok := c.Value(configContextKey).(*Config); ok {
+		return cfg
+	}
+	cfg := DefaultConfig()
+	return &cfg
+}
+
+// respondJSON writes obj as JSON response, indented when PrettyJSON of the config is enabled
+func respondJSON(c *gin.Context, code int, obj any) {
+	if requestConfig(c).PrettyJSON {
+		c.IndentedJSON(code, obj)
+		return
+	}
+	c.JSON(code, obj)
+}
+
+// abortWithJSON the same as gin.Context.AbortWithStatusJSON, but it respects PrettyJSON
+func abortWithJSON(c *gin.Context, code int, obj any) {
+	c.Abort()
+	respondJSON(c, code, obj)
+}
+
+// respondInternalError logs err with the request context and responds with 500 code,
+// or with 503 when store had no free connection, so client can retry later, or with 504 when request timed out.
+// The error itself is never returned to clients, because it can contain details of DB internals.
+func respondInternalError(c *gin.Context, message string, err error) {
+	slog.ErrorContext(c.Request.Context(), message, slog.Any("error", err))
+	if errors.Is(c.Request.Context().Err(), context.DeadlineExceeded) { // store call was canceled by RequestTimeout
+		respondTimeout(c)
+		return
+	}
+	if errors.Is(err, ErrStoreBusy) {
+		c.Header("Retry-After", "1")
+		respondJSON(
+			c,
+			http.StatusServiceUnavailable,
+			errorResponse(ErrorCodeUnavailable, "database is busy, try again later"),
+		)
+		return
+	}
+	respondJSON(c, http.StatusInternalServerError, errorResponse(ErrorCodeInternal, "internal server error"))
+}
+
+// createRouter initializes and configures a Gin router with list, GET, HEAD, POST, PUT and DELETE endpoints.
+// For simplicity, we keep handlers code inside this function, handlers work with data through the store.
+// Limits and optional features of the router are taken from cfg.
+func createRouter(store Store, cfg Config) (*gin.Engine, error) {
+	if err := registerValidators(); err != nil {
+		slog.Error("Failed to register validators", slog.Any("error", err))
+		return nil, err
+	}
+	// gin.Default() logs requests with its own logger, we use gin.New() to log through slog instead
+	router := gin.New()
+	// Wrong method on a known path gets 405 with Allow header set by Gin, instead of 404
+	router.HandleMethodNotAllowed = true
+	// Repeated slashes are collapsed, so "//" is the list and "//id" is the item, instead of redirects.
+	// Trailing slash isn't redirected, "/id/" gets JSON 404, because redirects of writes aren't followed
+	// by many clients, and "//id" was redirected to "//id/", which browsers treat as another host.
+	router.RemoveExtraSlash = true
+	router.RedirectTrailingSlash = false
+
+	// By default, we don't use any proxies, and client IP is taken from the connection
+	err := router.SetTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		slog.Error("Failed to set trusted proxies", slog.Any("error", err))
+		return nil, err
+	}
+
+	// Config goes first, so helpers like respondJSON see it in every handler
+	router.Use(func(c *gin.Context) {
+		c.Set(configContextKey, &cfg)
+	})
+	router.Use(requestIDMiddleware())
+	router.Use(accessLogMiddleware())
+
+	// Recovery goes after access log, so requests which caused panic are logged with 500 status
+	router.Use(recoveryMiddleware())
+	router.Use(drainingMiddleware())
+	router.Use(requestTimeoutMiddleware(cfg.RequestTimeout))
+
+	// Tracer is taken from global provider, it does nothing when tracing isn't configured
+	router.Use(tracingMiddleware(otel.Tracer(tracerName)))
+
+	if len(cfg.CORSAllowedOrigins) > 0 {
+		router.Use(corsMiddleware(cfg.CORSAllowedOrigins))
+	}
+	// CORS goes before gzip, so Vary header set by CORS isn't replaced
+	router.Use(gzipMiddleware(cfg.GzipMinSize))
+
+	// Unknown routes and methods get JSON errors like the rest of API, instead of Gin's plain text
+	router.NoRoute(func(c *gin.Context) {
+		respondJSON(c, http.StatusNotFound, errorResponse(ErrorCodeNotFound, "route not found"))
+	})
+	router.NoMethod(func(c *gin.Context) {
+		respondJSON(c, http.StatusMethodNotAllowed, errorResponse(ErrorCodeMethodNotAllowed, "method not allowed"))
+	})
+
+	// Liveness probe, it doesn't touch DB to stay cheap and independent of DB availability
+	router.GET("/healthz", func(c *gin.Context) {
+		respondJSON(c, http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	// Build metadata, so it's possible to check which build is deployed
+	router.GET("/version", func(c *gin.Context) {
+		respondJSON(c, http.StatusOK, gin.H{
+			"version":    Version,
+			"commit":     Commit,
+			"build_time": BuildTime,
+			"go_version": runtime.Version(),
+		})
+	})
+
+	// Readiness probe, it reports status of every dependency and overall status, so orchestrators can stop
+	// routing traffic to us when we are unhealthy. Degraded app still gets 200 code.
+	router.GET("/readyz", func(c *gin.Context) {
+		var pingErr error
+		var latency time.Duration
+		if storeUnhealthy.Load() { // health monitor noticed that DB is gone, no need to wait for another ping
+			pingErr = errors.New("database health check failed")
+		} else {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), cfg.OperationsTimeout/5)
+			defer cancel()
+			startedAt := time.Now()
+			pingErr = store.Ping(ctx)
+			latency = time.Since(startedAt)
+			if pingErr != nil {
+				slog.WarnContext(c.Request.Context(), "Database ping failed", slog.Any("error", pingErr))
+			}
+		}
+		pending := 0
+		if pingErr == nil {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), cfg.OperationsTimeout/5)
+			defer cancel()
+			var err error
+			if pending, err = store.PendingMigrations(ctx); err != nil {
+				slog.WarnContext(c.Request.Context(), "Failed to check pending migrations", slog.Any("error", err))
+			}
+		}
+		report := evaluateReadiness(pingErr, pending, store.PoolStats())
+		report.LatencyMs = latency.Milliseconds()
+		status := http.StatusOK
+		if report.Status == ReadinessUnhealthy {
+			status = http.StatusServiceUnavailable
+		}
+		respondJSON(c, status, report)
+	})
+
+	if cfg.EnablePprof {
+		registerPprofRoutes(router.Group("/debug/pprof", requireAPIKey(cfg.APIKey)))
+	}
+
+	// Effective configuration for operators, log level is taken at request time, because it's changed on reload
+	if cfg.EnableDebugConfig {
+		router.GET("/debug/config", requireAPIKey(cfg.APIKey), func(c *gin.Context) {
+			config := effectiveConfig(cfg)
+			config.Logging.Level = LogLevel.Level().String()
+			respondJSON(c, http.StatusOK, config)
+		})
+	}
+
+	// Stats of DB pool and Go runtime for dashboards and debugging, they expose internals,
+	// so they require API key the same way as writes
+	router.GET("/stats", requireAPIKey(cfg.APIKey), func(c *gin.Context) {
+		var memStats runtime.MemStats
+		runtime.ReadMemStats(&memStats)
+		respondJSON(c, http.StatusOK, gin.H{
+			"pool": store.PoolStats(),
+			"runtime": gin.H{
+				"goroutines":       runtime.NumGoroutine(),
+				"heap_alloc_bytes": memStats.HeapAlloc,
+				"gc_count":         memStats.NumGC,
+			},
+		})
+	})
+
+	// Probes are registered above, so they aren't affected by rate and concurrency limiting
+	if cfg.RateLimitRPS > 0 {
+		router.Use(newRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst).middleware())
+	}
+	if cfg.MaxConcurrentPerIP > 0 {
+		router.Use(newConcurrencyLimiter(cfg.MaxConcurrentPerIP).middleware())
+	}
+
+	// API routes are mounted under cfg.APIPrefix. Probes, /version and pprof handlers above stay at the root,
+	// so orchestrators and operators reach them directly, not through the reverse proxy.
+	api := router.Group(cfg.APIPrefix)
+	if cfg.CacheControlMaxAge > 0 {
+		api.Use(cacheControlMiddleware(cfg.CacheControlMaxAge))
+	}
+
+	api.GET("/openapi.json", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json", openAPISpec)
+	})
+
+	// Collection routes use empty path, so they don't get a trailing slash, e.g. /api/v1 instead of /api/v1/
+	api.GET("", func(c *gin.Context) {
+		limit, err := parseIntQuery(c, "limit", cfg.DefaultListLimit, cfg.MaxListLimit)
+		if err != nil {
+			respondValidationError(c, err)
+			return
+		}
+		offset, err := parseIntQuery(c, "offset", 0, cfg.MaxListOffset)
+		if err != nil {
+			respondValidationError(c, err)
+			return
+		}
+		after, err := parseCursorQuery(c)
+		if err != nil {
+			respondValidationError(c, err)
+			return
+		}
+		if after != "" && offset > 0 {
+			respondValidationError(c, FieldError{Field: "offset", Reason: "must not be used with cursor"})
+			return
+		}
+		// Soft-deleted items are shown to admins only, so it requires API key the same way as writes
+		includeDeleted := false
+		if raw := c.Query("include_deleted"); raw != "" {
+			includeDeleted, err = strconv.ParseBool(raw)
+			if err != nil {
+				respondValidationError(c, FieldError{Field: "include_deleted", Reason: "must be a boolean"})
+				return
+			}
+		}
+		envelope := false
+		if raw := c.Query("envelope"); raw != "" {
+			envelope, err = strconv.ParseBool(raw)
+			if err != nil {
+				respondValidationError(c, FieldError{Field: "envelope", Reason: "must be a boolean"})
+				return
+			}
+		}
+		if includeDeleted && !hasValidAPIKey(c, cfg.APIKey) {
+			respondJSON(c, http.StatusUnauthorized, errorResponse(ErrorCodeUnauthorized, "missing or invalid API key"))
+			return
+		}
+		// IDs aren't longer than MaxItemIDLength, so a longer prefix can't match anything
+		prefix, err := parseTextQuery(c, "prefix", MaxItemIDLength)
+		if err != nil {
+			respondValidationError(c, err)
+			return
+		}
+		items, err := store.List(c.Request.Context(), limit, offset, after, prefix, includeDeleted)
+		if err != nil {
+			respondInternalError(c, "Failed to list items", err)
+			return
+		}
+		c.Header(limitHeader, strconv.Itoa(limit))
+		page := ItemPage{Items: items}
+		// Full page means there can be more items, the last page may still be full, then the next one is empty
+		if limit > 0 && len(items) == limit {
+			page.NextCursor = encodeCursor(items[len(items)-1].ItemId)
+			c.Header(nextCursorHeader, page.NextCursor)
+		}
+		if envelope {
+			respondJSON(c, http.StatusOK, page)
+			return
+		}
+		respondJSON(c, http.StatusOK, items)
+	})
+
+	// Static routes are registered before /:item_id, so their names aren't taken as item IDs
+	api.GET("/count", func(c *gin.Context) {
+		count, err := store.Count(c.Request.Context())
+		if err != nil {
+			respondInternalError(c, "Failed to count items", err)
+			return
+		}
+		respondJSON(c, http.StatusOK, gin.H{"count": count})
+	})
+
+	// Export streams all items as newline-delimited JSON, items are written as they are read from the store,
+	// so memory usage doesn't depend on number of items
+	api.GET("/export", func(c *gin.Context) {
+		liftServerDeadlines(c)
+		c.Header("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(c.Writer)
+		err := store.Export(c.Request.Context(), func(item StoredItem) error {
+			return encoder.Encode(item)
+		})
+		if err != nil {
+			if c.Writer.Written() { // status is already sent, client sees the output cut short
+				slog.ErrorContext(c.Request.Context(), "Failed to export items", slog.Any("error", err))
+				return
+			}
+			c.Writer.Header().Del("Content-Type") // error response is JSON, not a stream
+			respondInternalError(c, "Failed to export items", err)
+		}
+	})
+
+	api.GET("/search", func(c *gin.Context) {
+		query, err := parseTextQuery(c, "q", cfg.MaxSearchQueryLength)
+		if err != nil {
+			respondValidationError(c, err)
+			return
+		}
+		if query == "" {
+			respondValidationError(c, FieldError{Field: "q", Reason: "must be a non-empty string"})
+			return
+		}
+		limit, err := parseIntQuery(c, "limit", cfg.DefaultListLimit, cfg.MaxListLimit)
+		if err != nil {
+			respondValidationError(c, err)
+			return
+		}
+		items, err := store.Search(c.Request.Context(), query, limit)
+		if err != nil {
+			respondInternalError(c, "Failed to search items", err)
+			return
+		}
+		c.Header(limitHeader, strconv.Itoa(limit))
+		respondJSON(c, http.StatusOK, items)
+	})
+
+	api.GET("/:item_id", func(c *gin.Context) {
+		itemID := c.Param("item_id")
+		if err := validateItemID(itemID); err != nil {
+			respondValidationError(c, err)
+			return
+		}
+		item, err := store.Get(c.Request.Context(), itemID)
+		if err != nil {
+			if errors.Is(err, ErrItemNotFound) {
+				respondNotFound(c)
+			} else {
+				respondInternalError(c, "Failed to get item", err)
+			}
+			return
+		}
+		value := valueJSON(item.Value, item.ValueIsJSON)
+		// JSON is the default, so clients without Accept header or with unsupported one get it
+		format := c.NegotiateFormat(gin.MIMEJSON, gin.MIMEXML, gin.MIMEXML2)
+		isXML := format == gin.MIMEXML || format == gin.MIMEXML2
+		etag := itemETag(string(value), item.Attributes)
+		if isXML {
+			etag = xmlETag(etag)
+		}
+		c.Header("ETag", etag)
+		// Vary is added to, not replaced, so Accept-Encoding of gzip and Origin of CORS are kept for caches
+		c.Writer.Header().Add("Vary", "Accept")
+		if etagMatches(c.GetHeader("If-None-Match"), etag) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+		if isXML {
+			c.XML(http.StatusOK, storedItemXML{StoredItem: item})
+			return
+		}
+		response := gin.H{
+			"value":      value,
+			"created_at": item.CreatedAt,
+			"updated_at": item.UpdatedAt,
+		}
+		if item.ExpiresAt != nil {
+			response["expires_at"] = item.ExpiresAt
+		}
+		if len(item.Attributes) > 0 {
+			response["attributes"] = item.Attributes
+		}
+		respondJSON(c, http.StatusOK, response)
+	})
+
+	// Batch GET uses POST, because list of IDs can be too long for URL. It doesn't modify data, so it's not protected
+	api.POST("/batch-get", func(c *gin.Context) {
+		var request BatchGetRequest
+		if !bindJSONBody(c, &request) {
+			return
+		}
+		if len(request.IDs) > cfg.MaxBatchGetIDs {
+			respondValidationError(c, FieldError{
+				Field: "ids", Reason: fmt.Sprintf("must not contain more than %d ids", cfg.MaxBatchGetIDs),
+			})
+			return
+		}
+		items, err := store.GetMany(c.Request.Context(), request.IDs)
+		if err != nil {
+			respondInternalError(c, "Failed to get items", err)
+			return
+		}
+		values := make(map[string]json.RawMessage, len(items))
+		for itemID, item := range items {
+			values[itemID] = valueJSON(item.Value, item.ValueIsJSON)
+		}
+		respondJSON(c, http.StatusOK, values)
+	})
+
+	// HEAD checks that item exists without transferring its value
+	api.HEAD("/:item_id", func(c *gin.Context) {
+		itemID := c.Param("item_id")
+		if validateItemID(itemID) != nil { // HEAD response has no body, so there's no place for the error message
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		err := store.Exists(c.Request.Context(), itemID)
+		if err != nil {
+			if errors.Is(err, ErrItemNotFound) {
+				c.Status(http.StatusNotFound)
+			} else {
+				slog.ErrorContext(c.Request.Context(), "Failed to check item", slog.Any("error", err))
+				status := http.StatusInternalServerError
+				if errors.Is(err, ErrStoreBusy) {
+					status = http.StatusServiceUnavailable
+				}
+				c.Status(status)
+			}
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	// Endpoints which modify data are protected by API key, when it's configured
+	writeRoutes := api.Group("", requireAPIKey(cfg.APIKey))
+	// Retried POST requests with Idempotency-Key header get the original response instead of inserting again
+	idempotency := newIdempotencyCache(cfg.IdempotencyWindow)
+
+	writeRoutes.POST("", idempotency.middleware(), func(c *gin.Context) {
+		dryRun, err := parseDryRun(c)
+		if err != nil {
+			respondValidationError(c, err)
+			return
+		}
+		var newItem NewItem
+		if !bindJSONBody(c, &newItem) {
+			return
+		}
+		if dryRun {
+			respondDryRunCreate(c, store, newItem.Item)
+			return
+		}
+		item, created, err := store.Put(c.Request.Context(), newItem.Item)
+		if err != nil {
+			respondInternalError(c, "Failed to create item", err)
+			return
+		}
+		if !created { // item already exists, nothing was inserted
+			if cfg.ConflictStatus == http.StatusConflict {
+				respondJSON(
+					c,
+					http.StatusConflict,
+					errorResponse(ErrorCodeConflict, "item with this item_id already exists"),
+				)
+			} else {
+				c.Status(http.StatusOK)
+			}
+			return
+		}
+		c.Header("Location", cfg.APIPrefix+"/"+url.PathEscape(item.ItemId))
+		respondJSON(c, http.StatusCreated, WrittenItem{StoredItem: item, Created: true})
+	})
+
+	// Unlike POST /, it replaces value of existing item, returning 201 for inserted and 200 for updated item
+	writeRoutes.POST("/upsert", idempotency.middleware(), func(c *gin.Context) {
+		var newItem Item
+		if !bindJSONBody(c, &newItem) {
+			return
+		}
+		item, inserted, err := store.Upsert(c.Request.Context(), newItem)
+		if err != nil {
+			respondInternalError(c, "Failed to upsert item", err)
+			return
+		}
+		if !inserted {
+			respondJSON(c, http.StatusOK, WrittenItem{StoredItem: item, Created: false})
+			return
+		}
+		c.Header("Location", cfg.APIPrefix+"/"+url.PathEscape(item.ItemId))
+		respondJSON(c, http.StatusCreated, WrittenItem{StoredItem: item, Created: true})
+	})
+
+	writeRoutes.POST("/bulk", idempotency.middleware(), func(c *gin.Context) {
+		var items []Item
+		if !bindJSONBody(c, &items) {
+			return
+		}
+		if len(items) > cfg.MaxBulkItems {
+			// body is an array of items, so the field is named after it
+			respondValidationError(c, FieldError{
+				Field: "items", Reason: fmt.Sprintf("must not contain more than %d items", cfg.MaxBulkItems),
+			})
+			return
+		}
+		created, err := store.BulkPut(c.Request.Context(), items)
+		if err != nil {
+			respondInternalError(c, "Failed to insert items", err)
+			return
+		}
+		respondJSON(c, http.StatusOK, gin.H{"created": created, "skipped": len(items) - created})
+	})
+
+	// Import reads items as newline-delimited JSON, e.g. produced by GET /export, and upserts them in batches
+	// of cfg.MaxBulkItems, so body size isn't limited by cfg.MaxBodyBytes. Invalid lines are skipped and reported.
+	// Batches imported before a store error stay in the store.
+	writeRoutes.POST("/import", func(c *gin.Context) {
+		liftServerDeadlines(c)
+		imported := 0
+		failedLines := []int{}
+		batch := make([]Item, 0, cfg.MaxBulkItems)
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			if err := store.BulkUpsert(c.Request.Context(), batch); err != nil {
+				return err
+			}
+			imported += len(batch)
+			batch = batch[:0]
+			return nil
+		}
+		scanner := bufio.NewScanner(c.Request.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), int(cfg.MaxBodyBytes))
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			var item Item
+			err := json.Unmarshal(scanner.Bytes(), &item)
+			if err == nil {
+				err = errors.Join(validateItemID(item.ItemId), validateValue(item.Value))
+			}
+			if err != nil || item.TTLSeconds < 0 {
+				failedLines = append(failedLines, line)
+				continue
+			}
+			batch = append(batch, item)
+			if len(batch) == cfg.MaxBulkItems {
+				if err := flush(); err != nil {
+					respondInternalError(c, "Failed to import items", err)
 					return
 				}
-			case <-time.After(time.Second * 5):
-				slog.Debug("Waiting for db-pool to close...")
 			}
 		}
-	}()
-	return dbPool, cleanDBPoolChannel, nil
-}
-
-// createRouter initializes and configures a Gin router with GET and POST endpoints.
-// For simplicity, we keep handlers code inside this function
-func createRouter(dbPool *pgxpool.Pool) (*gin.Engine, error) {
-	router := gin.Default()
+		if err := scanner.Err(); err != nil {
+			respondJSON(c, http.StatusBadRequest, errorResponse(ErrorCodeInvalidRequest, fmt.Sprintf("failed to read body: %s", err)))
+			return
+		}
+		if err := flush(); err != nil {
+			respondInternalError(c, "Failed to import items", err)
+			return
+		}
+		respondJSON(
+			c,
+			http.StatusOK,
+			gin.H{"imported": imported, "failed": len(failedLines), "failed_lines": failedLines},
+		)
+	})
 
-	// In this example, we don't use any proxies
-	err := router.SetTrustedProxies(nil)
-	if err != nil {
-		slog.Error("Failed to set trusted proxies", slog.Any("error", err))
-		return nil, err
-	}
+	writeRoutes.PUT("/:item_id", func(c *gin.Context) {
+		itemID := c.Param("item_id")
+		var update ItemUpdate
+		if !bindJSONBody(c, &update) {
+			return
+		}
+		if err := validateItemID(itemID); err != nil {
+			respondValidationError(c, err)
+			return
+		}
+		err := store.Update(c.Request.Context(), itemID, update)
+		if err != nil {
+			if errors.Is(err, ErrItemNotFound) {
+				respondNotFound(c)
+			} else {
+				respondInternalError(c, "Failed to update item", err)
+			}
+			return
+		}
+		c.Status(http.StatusOK)
+	})
 
-	router.GET("/:item_id", func(c *gin.Context) {
+	// Conditional update, it's applied only if If-Match header matches ETag of the current value returned by GET,
+	// so concurrent changes made after the client read the item aren't overwritten
+	writeRoutes.PATCH("/:item_id", func(c *gin.Context) {
 		itemID := c.Param("item_id")
-		var value string
-		err := dbPool.QueryRow(c.Request.Context(), "SELECT value FROM data WHERE id = $1", itemID).Scan(&value)
+		ifMatch := c.GetHeader("If-Match")
+		if ifMatch == "" {
+			respondJSON(c, http.StatusPreconditionRequired, errorResponse(ErrorCodePreconditionRequired, "If-Match header is required"))
+			return
+		}
+		var update ItemUpdate
+		if !bindJSONBody(c, &update) {
+			return
+		}
+		if err := validateItemID(itemID); err != nil {
+			respondValidationError(c, err)
+			return
+		}
+		// current value is read from the primary store, where CompareAndUpdate runs, lagging replica would fail it
+		item, err := store.Get(withPrimaryRead(c.Request.Context()), itemID)
 		if err != nil {
-			if errors.Is(err, pgx.ErrNoRows) {
-				c.Status(http.StatusNotFound)
+			if errors.Is(err, ErrItemNotFound) {
+				respondNotFound(c)
 			} else {
-				c.JSON(
-					http.StatusInternalServerError,
-					gin.H{"error": err.Error()},
+				respondInternalError(c, "Failed to get item", err)
+			}
+			return
+		}
+		// Client may have read the item as JSON or XML, both ETags identify the current value
+		etag := itemETag(string(valueJSON(item.Value, item.ValueIsJSON)), item.Attributes)
+		if !etagMatchesStrong(ifMatch, etag) && !etagMatchesStrong(ifMatch, xmlETag(etag)) {
+			respondJSON(
+				c,
+				http.StatusPreconditionFailed,
+				errorResponse(ErrorCodePreconditionFailed, "item was changed"),
+			)
+			return
+		}
+		current := ItemUpdate{Value: item.Value, ValueIsJSON: item.ValueIsJSON, Attributes: item.Attributes}
+		err = store.CompareAndUpdate(c.Request.Context(), itemID, current, update)
+		if err != nil {
+			if errors.Is(err, ErrItemNotFound) { // item was changed or removed after we read it
+				respondJSON(
+					c,
+					http.StatusPreconditionFailed,
+					errorResponse(ErrorCodePreconditionFailed, "item was changed"),
 				)
+			} else {
+				respondInternalError(c, "Failed to update item", err)
 			}
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{
-			"value": value,
-		})
+		if update.Attributes == nil { // attributes are kept, when they are omitted
+			update.Attributes = item.Attributes
+		}
+		c.Header("ETag", itemETag(string(valueJSON(update.Value, update.ValueIsJSON)), update.Attributes))
+		c.Status(http.StatusOK)
 	})
 
-	router.POST("/", func(c *gin.Context) {
-		var newItem Item
-		if err := c.ShouldBindBodyWithJSON(&newItem); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	// Bulk delete uses POST, because list of IDs can be too long for URL, and DELETE body is often dropped by proxies
+	writeRoutes.POST("/bulk-delete", func(c *gin.Context) {
+		var request BulkDeleteRequest
+		if !bindJSONBody(c, &request) {
 			return
 		}
-		res, err := dbPool.Exec(
-			c.Request.Context(),
-			"INSERT INTO data (id, value) VALUES ($1, $2) ON CONFLICT DO NOTHING",
-			newItem.ItemId, newItem.Value,
-		)
+		if len(request.IDs) > cfg.MaxBulkDeleteIDs {
+			respondValidationError(c, FieldError{
+				Field: "ids", Reason: fmt.Sprintf("must not contain more than %d ids", cfg.MaxBulkDeleteIDs),
+			})
+			return
+		}
+		deleted, err := store.DeleteMany(c.Request.Context(), request.IDs)
+		if err != nil {
+			respondInternalError(c, "Failed to delete items", err)
+			return
+		}
+		respondJSON(c, http.StatusOK, gin.H{"deleted": deleted})
+	})
 
+	writeRoutes.DELETE("", func(c *gin.Context) {
+		if !cfg.AllowTruncate {
+			respondJSON(c, http.StatusForbidden, errorResponse(ErrorCodeForbidden, "removing all items is disabled, set ALLOW_TRUNCATE=true to enable it"))
+			return
+		}
+		deleted, err := store.DeleteAll(c.Request.Context())
 		if err != nil {
-			c.JSON(
-				http.StatusInternalServerError,
-				gin.H{"error": err.Error()},
-			)
+			respondInternalError(c, "Failed to delete all items", err)
 			return
 		}
-		if res.RowsAffected() == 0 {
-			c.Status(http.StatusOK)
-		} else {
-			c.Status(http.StatusCreated)
+		respondJSON(c, http.StatusOK, gin.H{"deleted": deleted})
+	})
+
+	writeRoutes.DELETE("/:item_id", func(c *gin.Context) {
+		itemID := c.Param("item_id")
+		if err := validateItemID(itemID); err != nil {
+			respondValidationError(c, err)
+			return
+		}
+		err := store.Delete(c.Request.Context(), itemID)
+		if err != nil {
+			if errors.Is(err, ErrItemNotFound) {
+				respondNotFound(c)
+			} else {
+				respondInternalError(c, "Failed to delete item", err)
+			}
+			return
 		}
+		c.Status(http.StatusNoContent)
 	})
 	return router, nil
 }
 
-// startServer starts an HTTP server using the provided Gin router and listens on the specified port.
+// reloadConfig re-reads settings which can be changed without restarting the app, currently it's LOG_LEVEL only.
+// Invalid values are logged and ignored, so the app keeps running with the previous settings.
+func reloadConfig() {
+	level, err := parseLogLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		slog.Error("Invalid LOG_LEVEL env variable, keeping current log level", slog.Any("error", err))
+		return
+	}
+	LogLevel.Set(level)
+	slog.Info("Configuration reloaded", slog.String("log_level", level.String()))
+}
+
+// shutdownSignals OS signals which stop the app gracefully
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// reloadSignals OS signals which reload configuration without stopping the app. SIGHUP isn't a shutdown signal,
+// because it's sent to reload config, e.g. by `kill -HUP` or process managers.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
+
+// handleSignals reads signals from the channel, calling reload for every reload signal, and returns the first
+// shutdown signal, so caller can stop the app. Other signals are ignored.
+// It returns nil when the channel is closed without a shutdown signal.
+func handleSignals(signals <-chan os.Signal, reload func()) os.Signal {
+	for sig := range signals {
+		switch {
+		case slices.Contains(shutdownSignals, sig):
+			slog.Info("Received shutdown signal", slog.String("signal", sig.String()))
+			return sig
+		case slices.Contains(reloadSignals, sig):
+			reload()
+		default:
+			slog.Debug("Ignoring signal", slog.String("signal", sig.String()))
+		}
+	}
+	return nil
+}
+
+// startServer starts an HTTP server using the provided Gin router and listens on BindAddress and Port of cfg.
+// When cfg has certificate and key files, the server serves HTTPS instead.
 // It returns the started server and a channel to receive errors that might happen during server startup.
 // The server is run in a separate goroutine and the provided WaitGroup is used to wait for the server to stop.
 // If an error occurs during server startup, it is sent to the error channel.
-func startServer(router *gin.Engine, wg *sync.WaitGroup, port uint16) (*http.Server, chan error) {
+func startServer(router *gin.Engine, wg *sync.WaitGroup, cfg Config) (*http.Server, chan error) {
+	var handler http.Handler = router
+	if cfg.EnableH2C {
+		handler = h2c.NewHandler(router, &http2.Server{})
+	}
+	// Address is validated by LoadConfig, so it can't fail here
+	addr, _ := listenAddress(cfg.BindAddress, cfg.Port)
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: router,
+		Addr:           addr,
+		Handler:        handler,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+		ReadTimeout:    cfg.ServerReadTimeout,
+		WriteTimeout:   cfg.ServerWriteTimeout,
+		IdleTimeout:    cfg.ServerIdleTimeout,
 	}
 	errChan := make(chan error, 1)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		slog.Info("Starting HTTP server", slog.String("port", fmt.Sprintf("%d", port)))
-		if err := srv.ListenAndServe(); err != nil {
+		var err error
+		if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
+			slog.Info("Starting HTTPS server", slog.String("address", addr))
+			err = srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+		} else {
+			slog.Info("Starting HTTP server", slog.String("address", addr), slog.Bool("h2c", cfg.EnableH2C))
+			err = srv.ListenAndServe()
+		}
+		if err != nil {
 			if !errors.Is(err, http.ErrServerClosed) {
 				errChan <- err
 			}
@@ -161,100 +5139,615 @@ func startServer(router *gin.Engine, wg *sync.WaitGroup, port uint16) (*http.Ser
 	return srv, errChan
 }
 
+// startExpirySweeper starts a goroutine which removes expired items from the store every ExpirySweepInterval
+// of cfg until ctx is done
+func startExpirySweeper(ctx context.Context, store Store, cfg Config, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(cfg.ExpirySweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				slog.Debug("Expiry sweeper stopped")
+				return
+			case <-ticker.C:
+				sweepCtx, cancel := context.WithTimeout(ctx, cfg.OperationsTimeout)
+				deleted, err := store.DeleteExpired(sweepCtx)
+				cancel()
+				if err != nil && ctx.Err() == nil {
+					slog.Error("Failed to delete expired items", slog.Any("error", err))
+				} else if deleted > 0 {
+					slog.Debug("Expired items deleted", slog.Int("count", deleted))
+				}
+			}
+		}
+	}()
+}
+
+// checkStoreHealth pings the store and updates storeUnhealthy flag, logging only transitions between states.
+// Ping takes not longer than timeout. It returns ping error, but not when ctx is done, because it isn't a DB failure.
+func checkStoreHealth(ctx context.Context, store Store, timeout time.Duration) error {
+	pingCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := store.Ping(pingCtx)
+	if err != nil && ctx.Err() != nil { // monitor is stopping, it's not a DB failure
+		return nil
+	}
+	wasUnhealthy := storeUnhealthy.Swap(err != nil)
+	if err != nil && !wasUnhealthy {
+		slog.Error("Database became unhealthy", slog.Any("error", err))
+	} else if err == nil && wasUnhealthy {
+		slog.Info("Database is healthy again")
+	}
+	return err
+}
+
+// Overall and per-dependency statuses reported by /readyz. Degraded app still serves requests, so it's
+// reported with 200 code, orchestrators shouldn't stop routing traffic to it.
+const (
+	ReadinessHealthy   = "healthy"
+	ReadinessDegraded  = "degraded"
+	ReadinessUnhealthy = "unhealthy"
+)
+
+// degradedPoolUtilization share of acquired DB connections, starting from which the pool is reported as degraded
+const degradedPoolUtilization = 0.9
+
+// DependencyCheck status of a single dependency reported by /readyz, Detail explains why it isn't healthy
+type DependencyCheck struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// ReadinessReport body of /readyz response, Status is the worst status of Checks
+type ReadinessReport struct {
+	Status    string                     `json:"status"`
+	LatencyMs int64                      `json:"latency_ms"`
+	Checks    map[string]DependencyCheck `json:"checks"`
+}
+
+// evaluateReadiness builds /readyz report from states of dependencies: DB ping error, number of pending migrations
+// and DB pool stats. Unreachable DB makes the app unhealthy. Busy or highly utilized pool makes it degraded,
+// requests are still served, but they may wait for connections. Pending migrations make it degraded too,
+// schema mismatch breaks only requests which use the missing changes.
+func evaluateReadiness(pingErr error, pending int, pool PoolStats) ReadinessReport {
+	checks := map[string]DependencyCheck{
+		"database":   {Status: ReadinessHealthy},
+		"migrations": {Status: ReadinessHealthy},
+		"pool":       {Status: ReadinessHealthy},
+	}
+	switch {
+	case errors.Is(pingErr, ErrStoreBusy):
+		checks["database"] = DependencyCheck{Status: ReadinessDegraded, Detail: "no free database connection"}
+	case pingErr != nil:
+		checks["database"] = DependencyCheck{Status: ReadinessUnhealthy, Detail: "database is unreachable"}
+	}
+	if pending > 0 {
+		checks["migrations"] = DependencyCheck{
+			Status: ReadinessDegraded,
+			Detail: fmt.Sprintf("%d migrations aren't applied", pending),
+		}
+	}
+	if pool.MaxConns > 0 && float64(pool.AcquiredConns)/float64(pool.MaxConns) >= degradedPoolUtilization {
+		checks["pool"] = DependencyCheck{
+			Status: ReadinessDegraded,
+			Detail: fmt.Sprintf("%d of %d connections are acquired", pool.AcquiredConns, pool.MaxConns),
+		}
+	}
+	report := ReadinessReport{Status: ReadinessHealthy, Checks: checks}
+	for _, check := range checks {
+		if check.Status == ReadinessUnhealthy || (check.Status == ReadinessDegraded && report.Status == ReadinessHealthy) {
+			report.Status = check.Status
+		}
+	}
+	return report
+}
+
+// poolRestarter is implemented by stores which can replace their DB connection pool
+type poolRestarter interface {
+	RestartPool(ctx context.Context) error
+}
+
+// startHealthMonitor pings the store with HealthCheckInterval of cfg in background to update readiness,
+// until ctx is canceled. When restarter isn't nil, its pool is restarted after DBPoolRestartFailures
+// consecutive failed pings.
+func startHealthMonitor(ctx context.Context, store Store, restarter poolRestarter, cfg Config, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(cfg.HealthCheckInterval)
+		defer ticker.Stop()
+		failures := 0
+		for {
+			select {
+			case <-ctx.Done():
+				slog.Debug("Health monitor stopped")
+				return
+			case <-ticker.C:
+				if checkStoreHealth(ctx, store, cfg.OperationsTimeout/5) == nil {
+					failures = 0
+					continue
+				}
+				failures++
+				if restarter == nil || cfg.DBPoolRestartFailures == 0 || failures < cfg.DBPoolRestartFailures {
+					continue
+				}
+				failures = 0 // the next restart is attempted after the same number of failures
+				restartCtx, cancel := context.WithTimeout(ctx, cfg.OperationsTimeout)
+				if err := restarter.RestartPool(restartCtx); err != nil {
+					slog.Error("Failed to restart DB connection pool", slog.Any("error", err))
+				} else {
+					slog.Warn(
+						"DB connection pool restarted after failed health checks",
+						slog.Int("failures", cfg.DBPoolRestartFailures),
+					)
+				}
+				cancel()
+			}
+		}
+	}()
+}
+
 // gracefulShutdown gracefully shuts down the server and database connections.
-// It waits for the server to stop and the database pool to close.
-// If success is true, it means the shutdown was initiated by an OS signal.
-// In this case, it logs a success message and exits with code 0.
-// If causedByOSSignal is false, it means the shutdown was initiated by an error.
-// In this case, it logs a warning message and exits with code 1.
-func gracefulShutdown(success bool, srv *http.Server, wg *sync.WaitGroup, cleanDBPoolChannel chan bool) {
+// It waits for the server to stop and the database pool to close, but not longer than shutdownTimeout.
+// srv can be nil if app initialization failed before the server was started, then only DB pool is closed.
+// tracerProvider is nil when tracing is disabled, otherwise it's shut down to export remaining spans.
+// stopBackgroundTasks cancels context of background goroutines like expiry sweeper, it can be nil.
+// It returns error if something didn't stop gracefully.
+func gracefulShutdown(
+	srv *http.Server,
+	wg *sync.WaitGroup,
+	cleanDBPoolChannel chan bool,
+	tracerProvider *sdktrace.TracerProvider,
+	stopBackgroundTasks context.CancelFunc,
+	shutdownTimeout time.Duration,
+) error {
 	slog.Info("Server is shutting down...")
-	ctx, cancelServerShutdown := context.WithTimeout(context.Background(), OperationsTimeout)
+	draining.Store(true)
+	ctx, cancelServerShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+
 	defer cancelServerShutdown()
-	err := srv.Shutdown(ctx)
-	if err != nil {
-		slog.Error("Failed to gracefully shutdown server", slog.Any("error", err))
+	var err error
+	if srv != nil { // server is nil when app initialization failed before we started it
+		err = srv.Shutdown(ctx)
+		if err != nil {
+			slog.Error("Failed to gracefully shutdown server", slog.Any("error", err))
+			err = fmt.Errorf("failed to gracefully shutdown server: %w", err)
+		}
+	}
+	if stopBackgroundTasks != nil { // background tasks use DB, so we stop them before closing the pool
+		stopBackgroundTasks()
 	}
 	cleanDBPoolChannel <- true // Signal db pool to close when server is shutting down
-	wg.Wait()
-	if success && err == nil { // we got OS signal to stop, and we didn't get any error during shutdown
-		slog.Info("Server gracefully shut down")
-		os.Exit(0)
-	} else { // something went wrong, channel was just closed by us
-		slog.Warn("Server terminated, check logs for errors")
-		os.Exit(1)
+	if tracerProvider != nil { // flush spans of the last requests
+		if tracingErr := tracerProvider.Shutdown(ctx); tracingErr != nil {
+			slog.Error("Failed to shutdown tracing", slog.Any("error", tracingErr))
+		}
+	}
+	// Wait for DB pools, including the ones replaced by RestartPool, and background goroutines, but not longer
+	// than shutdown timeout, so a stuck goroutine or a connection which is never released can't hang shutdown forever
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("DB pools are closed and background goroutines are finished")
+	case <-ctx.Done():
+		slog.Warn("Background goroutines didn't finish in time, exiting anyway")
+		err = errors.Join(err, errors.New("background goroutines didn't finish in time"))
 	}
+	return err
 }
 
-func main() {
-	// Basic logging setup, we print INFO and above to STDOUT
-	slog.SetDefault(
-		slog.New(
-			tint.NewHandler(
-				os.Stdout,
-				&tint.Options{Level: slog.LevelInfo},
-			),
-		),
+// redactedSecret replaces values of secrets in logged configuration
+const redactedSecret = "[REDACTED]"
+
+// redactSecret hides non-empty secret, empty one is kept, so it's visible that the secret isn't set
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redactedSecret
+}
+
+// redactURL hides password, path and query of URL, they can contain credentials or tokens,
+// e.g. webhook URLs often do. Unparsable URL is hidden completely.
+func redactURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Host == "" {
+		return redactedSecret
+	}
+	redacted := parsed.Scheme + "://"
+	if parsed.User != nil {
+		redacted += parsed.User.Username()
+		if _, hasPassword := parsed.User.Password(); hasPassword {
+			redacted += ":" + redactedSecret
+		}
+		redacted += "@"
+	}
+	redacted += parsed.Host
+	if (parsed.Path != "" && parsed.Path != "/") || parsed.RawQuery != "" {
+		redacted += "/" + redactedSecret
+	}
+	return redacted
+}
+
+// EffectiveConfig configuration the app runs with after env variables are applied, secrets are redacted,
+// so it's safe to log it
+type EffectiveConfig struct {
+	Server   ServerConfigSummary   `json:"server"`
+	Logging  LoggingConfigSummary  `json:"logging"`
+	Database DatabaseConfigSummary `json:"database"`
+	Limits   LimitsConfigSummary   `json:"limits"`
+	Features FeaturesConfigSummary `json:"features"`
+}
+
+// ServerConfigSummary HTTP server part of EffectiveConfig
+type ServerConfigSummary struct {
+	BindAddress     string `json:"bind_address"`
+	Port            uint16 `json:"port"`
+	APIPrefix       string `json:"api_prefix"`
+	GinMode         string `json:"gin_mode"`
+	TLSCertFile     string `json:"tls_cert_file"`
+	TLSKeyFile      string `json:"tls_key_file"`
+	EnableH2C       bool   `json:"enable_h2c"`
+	ReadTimeout     string `json:"read_timeout"`
+	WriteTimeout    string `json:"write_timeout"`
+	IdleTimeout     string `json:"idle_timeout"`
+	RequestTimeout  string `json:"request_timeout"`
+	ShutdownTimeout string `json:"shutdown_timeout"`
+}
+
+// LoggingConfigSummary logging part of EffectiveConfig
+type LoggingConfigSummary struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+// DatabaseConfigSummary database part of EffectiveConfig. Connection parameters are taken from parsed
+// connection string, so they are the same for DATABASE_URL and PG* env variables, and password is never included.
+type DatabaseConfigSummary struct {
+	Driver              string `json:"driver"`
+	SQLitePath          string `json:"sqlite_path,omitempty"`
+	Host                string `json:"host,omitempty"`
+	Port                uint16 `json:"port,omitempty"`
+	Name                string `json:"name,omitempty"`
+	User                string `json:"user,omitempty"`
+	ReplicaHost         string `json:"replica_host,omitempty"`
+	PoolMaxConns        int32  `json:"pool_max_conns,omitempty"`
+	PoolMinConns        int32  `json:"pool_min_conns,omitempty"`
+	PoolMaxConnLifetime string `json:"pool_max_conn_lifetime,omitempty"`
+	PoolMaxConnIdleTime string `json:"pool_max_conn_idle_time,omitempty"`
+	StatementTimeoutMs  string `json:"statement_timeout_ms,omitempty"`
+	PgBouncerMode       bool   `json:"pgbouncer_mode,omitempty"`
+	ConfigError         string `json:"config_error,omitempty"`
+	AcquireTimeout      string `json:"acquire_timeout"`
+	ConnectAttempts     int    `json:"connect_attempts"`
+	ConnectRetryDelay   string `json:"connect_retry_delay"`
+	OperationsTimeout   string `json:"operations_timeout"`
+	HealthCheckInterval string `json:"health_check_interval"`
+	PoolRestartFailures int    `json:"pool_restart_failures"`
+	QueryAttempts       int    `json:"query_attempts"`
+	SlowQueryThreshold  string `json:"slow_query_threshold"`
+}
+
+// LimitsConfigSummary request limits part of EffectiveConfig
+type LimitsConfigSummary struct {
+	MaxBodyBytes         int64   `json:"max_body_bytes"`
+	MaxHeaderBytes       int     `json:"max_header_bytes"`
+	DefaultListLimit     int     `json:"default_list_limit"`
+	MaxListLimit         int     `json:"max_list_limit"`
+	MaxListOffset        int     `json:"max_list_offset"`
+	MaxSearchQueryLength int     `json:"max_search_query_length"`
+	MaxBatchGetIDs       int     `json:"max_batch_get_ids"`
+	MaxBulkItems         int     `json:"max_bulk_items"`
+	MaxBulkDeleteIDs     int     `json:"max_bulk_delete_ids"`
+	RateLimitRPS         float64 `json:"rate_limit_rps"`
+	RateLimitBurst       int     `json:"rate_limit_burst"`
+	MaxConcurrentPerIP   int     `json:"max_concurrent_per_ip"`
+}
+
+// FeaturesConfigSummary optional features part of EffectiveConfig
+type FeaturesConfigSummary struct {
+	APIKey              string   `json:"api_key"`
+	CORSAllowedOrigins  []string `json:"cors_allowed_origins"`
+	TrustedProxies      []string `json:"trusted_proxies"`
+	AllowedContentTypes []string `json:"allowed_content_types"`
+	AllowTruncate       bool     `json:"allow_truncate"`
+	PrettyJSON          bool     `json:"pretty_json"`
+	EnablePprof         bool     `json:"enable_pprof"`
+	EnableDebugConfig   bool     `json:"enable_debug_config"`
+	GzipMinSize         int      `json:"gzip_min_size"`
+	CacheSize           int      `json:"cache_size"`
+	CacheControlMaxAge  int      `json:"cache_control_max_age"`
+	ConflictStatus      int      `json:"conflict_status"`
+	ExpirySweepInterval string   `json:"expiry_sweep_interval"`
+	IdempotencyWindow   string   `json:"idempotency_window"`
+	OTLPEndpoint        string   `json:"otlp_endpoint"`
+	WebhookURL          string   `json:"webhook_url"`
+	WebhookWorkers      int      `json:"webhook_workers"`
+	WebhookAttempts     int      `json:"webhook_attempts"`
+	KafkaBrokers        []string `json:"kafka_brokers"`
+	KafkaTopic          string   `json:"kafka_topic"`
+}
+
+// effectiveConfig summarizes cfg for logs and /debug/config endpoint with secrets redacted
+func effectiveConfig(cfg Config) EffectiveConfig {
+	return EffectiveConfig{
+		Server: ServerConfigSummary{
+			BindAddress:     cfg.BindAddress,
+			Port:            cfg.Port,
+			APIPrefix:       cfg.APIPrefix,
+			GinMode:         cfg.GinMode,
+			TLSCertFile:     cfg.TLSCertFile,
+			TLSKeyFile:      cfg.TLSKeyFile,
+			EnableH2C:       cfg.EnableH2C,
+			ReadTimeout:     cfg.ServerReadTimeout.String(),
+			WriteTimeout:    cfg.ServerWriteTimeout.String(),
+			IdleTimeout:     cfg.ServerIdleTimeout.String(),
+			RequestTimeout:  cfg.RequestTimeout.String(),
+			ShutdownTimeout: cfg.ShutdownTimeout.String(),
+		},
+		Logging:  LoggingConfigSummary{Level: cfg.LogLevel.String(), Format: cfg.LogFormat},
+		Database: databaseConfigSummary(cfg),
+		Limits: LimitsConfigSummary{
+			MaxBodyBytes:         cfg.MaxBodyBytes,
+			MaxHeaderBytes:       cfg.MaxHeaderBytes,
+			DefaultListLimit:     cfg.DefaultListLimit,
+			MaxListLimit:         cfg.MaxListLimit,
+			MaxListOffset:        cfg.MaxListOffset,
+			MaxSearchQueryLength: cfg.MaxSearchQueryLength,
+			MaxBatchGetIDs:       cfg.MaxBatchGetIDs,
+			MaxBulkItems:         cfg.MaxBulkItems,
+			MaxBulkDeleteIDs:     cfg.MaxBulkDeleteIDs,
+			RateLimitRPS:         cfg.RateLimitRPS,
+			RateLimitBurst:       cfg.RateLimitBurst,
+			MaxConcurrentPerIP:   cfg.MaxConcurrentPerIP,
+		},
+		Features: FeaturesConfigSummary{
+			APIKey:              redactSecret(cfg.APIKey),
+			CORSAllowedOrigins:  cfg.CORSAllowedOrigins,
+			TrustedProxies:      cfg.TrustedProxies,
+			AllowedContentTypes: cfg.AllowedContentTypes,
+			AllowTruncate:       cfg.AllowTruncate,
+			PrettyJSON:          cfg.PrettyJSON,
+			EnablePprof:         cfg.EnablePprof,
+			EnableDebugConfig:   cfg.EnableDebugConfig,
+			GzipMinSize:         cfg.GzipMinSize,
+			CacheSize:           cfg.CacheSize,
+			CacheControlMaxAge:  cfg.CacheControlMaxAge,
+			ConflictStatus:      cfg.ConflictStatus,
+			ExpirySweepInterval: cfg.ExpirySweepInterval.String(),
+			IdempotencyWindow:   cfg.IdempotencyWindow.String(),
+			OTLPEndpoint:        redactURL(cfg.OTLPEndpoint),
+			WebhookURL:          redactURL(cfg.WebhookURL),
+			WebhookWorkers:      cfg.WebhookWorkers,
+			WebhookAttempts:     cfg.WebhookAttempts,
+			KafkaBrokers:        cfg.KafkaBrokers,
+			KafkaTopic:          cfg.KafkaTopic,
+		},
+	}
+}
+
+// databaseConfigSummary summarizes database part of cfg for EffectiveConfig. Invalid connection string
+// or pool settings are reported in ConfigError, the app fails with the same error when it connects to DB.
+func databaseConfigSummary(cfg Config) DatabaseConfigSummary {
+	config := DatabaseConfigSummary{
+		Driver:              cfg.DBDriver,
+		AcquireTimeout:      cfg.DBAcquireTimeout.String(),
+		ConnectAttempts:     cfg.DBConnectAttempts,
+		ConnectRetryDelay:   cfg.DBConnectRetryDelay.String(),
+		OperationsTimeout:   cfg.OperationsTimeout.String(),
+		HealthCheckInterval: cfg.HealthCheckInterval.String(),
+		PoolRestartFailures: cfg.DBPoolRestartFailures,
+		QueryAttempts:       cfg.DBQueryAttempts,
+		SlowQueryThreshold:  cfg.SlowQueryThreshold.String(),
+	}
+	if cfg.DBDriver == "sqlite" {
+		config.SQLitePath = cfg.SQLitePath
+		return config
+	}
+	connString, source := dbConnString(cfg)
+	poolConfig, err := buildPoolConfig(connString, cfg)
+	if err != nil {
+		// pgx errors can quote the connection string, so only the source is reported
+		config.ConfigError = "invalid " + source
+		return config
+	}
+	config.Host, config.Port = poolConfig.ConnConfig.Host, poolConfig.ConnConfig.Port
+	config.Name, config.User = poolConfig.ConnConfig.Database, poolConfig.ConnConfig.User
+	config.PoolMaxConns, config.PoolMinConns = poolConfig.MaxConns, poolConfig.MinConns
+	config.PoolMaxConnLifetime = poolConfig.MaxConnLifetime.String()
+	config.PoolMaxConnIdleTime = poolConfig.MaxConnIdleTime.String()
+	config.StatementTimeoutMs = poolConfig.ConnConfig.RuntimeParams["statement_timeout"]
+	config.PgBouncerMode = cfg.PgBouncerMode
+	if cfg.DatabaseReplicaURL != "" {
+		if replicaConfig, err := pgxpool.ParseConfig(cfg.DatabaseReplicaURL); err == nil {
+			config.ReplicaHost = replicaConfig.ConnConfig.Host
+		}
+	}
+	return config
+}
+
+// logEffectiveConfig logs configuration the app runs with, so it's visible which env variables took effect
+func logEffectiveConfig(config EffectiveConfig) {
+	slog.Info("Effective configuration",
+		slog.Any("server", config.Server),
+		slog.Any("logging", config.Logging),
+		slog.Any("database", config.Database),
+		slog.Any("limits", config.Limits),
+		slog.Any("features", config.Features),
 	)
+}
+
+// ErrStartupInterrupted is returned by run when ctx is canceled before the server started, e.g. by stop signal
+// while DB is still unreachable. Startup steps use contexts derived from ctx, so they are aborted right away.
+var ErrStartupInterrupted = errors.New("startup interrupted")
+
+// startupError marks err of a startup step with ErrStartupInterrupted when ctx is canceled,
+// because then the step failed due to the stop of the app, not due to the failure itself
+func startupError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %w", ErrStartupInterrupted, err)
+	}
+	return err
+}
 
-	var interruptAppInitialization = false
+// run sets up DB, router and HTTP server, and serves requests until ctx is canceled or the server fails.
+// Everything it started is shut down gracefully before it returns. It returns error if initialization
+// or the server failed, or if shutdown wasn't graceful.
+func run(ctx context.Context, cfg Config) error {
 	// Wait group to wait for db pool to close and for HTTP server to stop
 	wg := &sync.WaitGroup{}
 
-	// Create a channel to receive OS signals when we need to stop the server
-	// this channel can be CLOSED by main goroutine if app initialization failed and we have to stop right away
-	termination := make(chan os.Signal, 1)
-	signal.Notify(termination, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
-
-	// Connect to DB and create connections pool for handlers
-	ctx, cancelDBConnect := context.WithTimeout(context.Background(), OperationsTimeout)
+	// Connect to DB and create connections pool for handlers, then initialize DB structure
+	dbConnectCtx, cancelDBConnect := context.WithTimeout(ctx, cfg.OperationsTimeout)
 	defer cancelDBConnect() // ensure we always call it to avoid leakage
-	dbPool, cleanDBPoolChannel, err := connectToDB(ctx, wg)
+	store, cleanDBPoolChannel, err := openStore(dbConnectCtx, wg, cfg)
 	if err != nil {
-		slog.Error("Failed to create db connections pool", slog.Any("error", err))
-		close(termination)
-		interruptAppInitialization = true
+		err = fmt.Errorf("failed to open %s store: %w", cfg.DBDriver, err)
+		return errors.Join(
+			startupError(ctx, err), gracefulShutdown(nil, wg, cleanDBPoolChannel, nil, nil, cfg.ShutdownTimeout),
+		)
 	}
 
-	// Initialize DB structure if DB connection didn't fail'
-	if !interruptAppInitialization {
-		ctx, cancelInitDB := context.WithTimeout(context.Background(), OperationsTimeout)
-		defer cancelInitDB() // ensure we always call it just in case, to avoid leakage
-		err = initDBStructure(ctx, dbPool)
+	// Set up tracing if it's configured
+	var tracerProvider *sdktrace.TracerProvider
+	if cfg.OTLPEndpoint != "" {
+		setupTracingCtx, cancelSetupTracing := context.WithTimeout(ctx, cfg.OperationsTimeout)
+		defer cancelSetupTracing() // ensure we always call it just in case, to avoid leakage
+		tracerProvider, err = setupTracing(setupTracingCtx, cfg.OTLPEndpoint)
 		if err != nil {
-			slog.Error("Failed to init DB structure", slog.Any("error", err))
-			close(termination)
-			interruptAppInitialization = true
+			err = fmt.Errorf("failed to set up tracing: %w", err)
+			return errors.Join(
+				startupError(ctx, err), gracefulShutdown(nil, wg, cleanDBPoolChannel, nil, nil, cfg.ShutdownTimeout),
+			)
 		}
 	}
 
-	// Create a new Gin router with handlers, if app initialization didn't fail
-	var router *gin.Engine
-	if !interruptAppInitialization {
-		// Create a new Gin router and start the server
-		router, err = createRouter(dbPool)
-		if err != nil {
-			slog.Error("Failed to create router", slog.Any("error", err))
-			close(termination)
-			interruptAppInitialization = true
+	// Background tasks are stopped during graceful shutdown by canceling their context,
+	// webhook notifier is stopped after the server, so it drains notifications of the last requests
+	backgroundCtx, cancelBackgroundTasks := context.WithCancel(context.Background())
+	var notifier *webhookNotifier
+	if cfg.WebhookURL != "" {
+		notifier = newWebhookNotifier(cfg.WebhookURL, cfg.WebhookWorkers, cfg.WebhookAttempts, cfg.OperationsTimeout, wg)
+	}
+	var publisher eventPublisher
+	if len(cfg.KafkaBrokers) > 0 {
+		publisher = newKafkaPublisher(cfg.KafkaBrokers, cfg.KafkaTopic)
+	}
+	stopBackgroundTasks := func() {
+		cancelBackgroundTasks()
+		if notifier != nil {
+			notifier.close()
+		}
+		if publisher != nil { // it flushes events of the last requests
+			if err := publisher.Close(); err != nil {
+				slog.Error("Failed to close Kafka publisher", slog.Any("error", err))
+			}
 		}
 	}
 
-	// Start HTTP server
-	var srv *http.Server
-	var serverStartErrChan chan error
-	if !interruptAppInitialization {
-		srv, serverStartErrChan = startServer(router, wg, HttpServerPort)
-		slog.Info("Server started, and ready to serve requests")
+	// Wrappers don't expose RestartPool, so health monitor gets the store itself
+	restarter, _ := store.(poolRestarter)
+
+	// Wrap the store with optional retries, slow calls log, tracing, notifications and cache,
+	// then create a new Gin router. Retries are the innermost, so slow calls log and traces cover all attempts
+	// of a call, and notifications and cache see it once.
+	if cfg.DBQueryAttempts > 1 {
+		store = &retryingStore{Store: store, attempts: cfg.DBQueryAttempts}
+	}
+	if cfg.SlowQueryThreshold > 0 {
+		store = &slowQueryStore{Store: store, threshold: cfg.SlowQueryThreshold}
+	}
+	if tracerProvider != nil {
+		store = &tracingStore{Store: store, tracer: tracerProvider.Tracer(tracerName)}
+	}
+	if notifier != nil {
+		store = &webhookStore{Store: store, notifier: notifier}
+	}
+	if publisher != nil {
+		store = &eventStore{Store: store, publisher: publisher}
+	}
+	if cfg.CacheSize > 0 {
+		store = newCachedStore(store, cfg.CacheSize)
+	}
+	router, err := createRouter(store, cfg)
+	if err != nil {
+		err = fmt.Errorf("failed to create router: %w", err)
+		return errors.Join(err, gracefulShutdown(
+			nil, wg, cleanDBPoolChannel, tracerProvider, stopBackgroundTasks, cfg.ShutdownTimeout,
+		))
 	}
 
-	// Wait for one of the signals to stop the app
+	// Start background tasks
+	startExpirySweeper(backgroundCtx, store, cfg, wg)
+	startHealthMonitor(backgroundCtx, store, restarter, cfg, wg)
+
+	// Start HTTP server, and wait until we have to stop the app
+	srv, serverStartErrChan := startServer(router, wg, cfg)
+	slog.Info("Server started, and ready to serve requests")
 	select {
-	case <-serverStartErrChan: // Server failed to start, stop app with 1 exit code
-		slog.Error("Failed to start server", slog.Any("error", serverStartErrChan))
-		gracefulShutdown(false, srv, wg, cleanDBPoolChannel)
-	case _, ok := <-termination: // App was terminated by an OS signal, or by us closing the channel(which means error)
-		slog.Debug("Will stop the app", slog.Bool("caused_by_os_signal", ok))
-		gracefulShutdown(ok, srv, wg, cleanDBPoolChannel)
+	case err = <-serverStartErrChan:
+		err = fmt.Errorf("failed to start server: %w", err)
+	case <-ctx.Done():
+		slog.Debug("Will stop the app", slog.Any("cause", context.Cause(ctx)))
+	}
+	return errors.Join(err, gracefulShutdown(
+		srv, wg, cleanDBPoolChannel, tracerProvider, stopBackgroundTasks, cfg.ShutdownTimeout,
+	))
+
+}
+
+func main() {
+	// Env variables are read and validated in one place, settings are passed down from here
+	cfg, err := LoadConfig()
+	// Basic logging setup, we print messages with LOG_LEVEL(INFO by default) and above to STDOUT
+	// in LOG_FORMAT(human-readable text by default). Invalid config is zero, so its error is logged as text.
+	LogLevel.Set(cfg.LogLevel)
+	logHandler, _ := newLogHandler(os.Stdout, cfg.LogFormat, LogLevel)
+	slog.SetDefault(slog.New(logHandler))
+	if err != nil {
+		slog.Error("Invalid configuration", slog.Any("error", err))
+		os.Exit(1)
+	}
+	// Mode has to be set before the router is created, in debug mode Gin logs every registered route
+	gin.SetMode(cfg.GinMode)
+	if cfg.ServerWriteTimeout > 0 && cfg.RequestTimeout >= cfg.ServerWriteTimeout {
+		slog.Warn(
+			"SERVER_WRITE_TIMEOUT isn't longer than REQUEST_TIMEOUT, slow requests are cut off without 504 response",
+			slog.Duration("write_timeout", cfg.ServerWriteTimeout),
+			slog.Duration("request_timeout", cfg.RequestTimeout),
+		)
+	}
+	logEffectiveConfig(effectiveConfig(cfg))
+
+	// The app runs until it gets an OS signal to stop, or until it fails, reload signals don't stop it
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, slices.Concat(shutdownSignals, reloadSignals)...)
+	defer signal.Stop(signals)
+	ctx, stop := context.WithCancelCause(context.Background())
+	defer stop(nil)
+	go func() {
+		if sig := handleSignals(signals, reloadConfig); sig != nil {
+			stop(fmt.Errorf("received %s signal", sig))
+		}
+	}()
+	err = run(ctx, cfg)
+	if errors.Is(err, ErrStartupInterrupted) { // stop was requested, so it isn't a failure
+		slog.Info("Server stopped during startup", slog.Any("error", err))
+		return
+	}
+	if err != nil {
+		slog.Error("Server terminated, check logs for errors", slog.Any("error", err))
+		os.Exit(1)
 	}
+	slog.Info("Server gracefully shut down")
 }
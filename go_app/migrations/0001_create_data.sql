@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS data (id text PRIMARY KEY, value text);
@@ -0,0 +1,2 @@
+ALTER TABLE data ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT now();
+ALTER TABLE data ADD COLUMN IF NOT EXISTS updated_at timestamptz NOT NULL DEFAULT now();
@@ -0,0 +1 @@
+ALTER TABLE data ADD COLUMN IF NOT EXISTS expires_at timestamptz NULL;
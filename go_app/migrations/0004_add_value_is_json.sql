@@ -0,0 +1 @@
+ALTER TABLE data ADD COLUMN IF NOT EXISTS value_is_json boolean NOT NULL DEFAULT false;
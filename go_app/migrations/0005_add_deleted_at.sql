@@ -0,0 +1 @@
+ALTER TABLE data ADD COLUMN IF NOT EXISTS deleted_at timestamptz NULL;
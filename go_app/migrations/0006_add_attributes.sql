@@ -0,0 +1 @@
+ALTER TABLE data ADD COLUMN IF NOT EXISTS attributes jsonb NOT NULL DEFAULT '{}'::jsonb;